@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ErrNoToken is returned when a request carries no bearer token.
+var ErrNoToken = errors.New("no bearer token")
+
+// Claims are the token claims used by the connector.
+type Claims struct {
+	jwt.RegisteredClaims
+
+	// Tenant the subject belongs to.
+	Tenant string `json:"tenant,omitempty"`
+	// Key binds the connection to a client key: the key handshake must
+	// claim the same key.
+	Key string `json:"key,omitempty"`
+}
+
+// TokenValidator validates bearer tokens: JWTs signed with HS256 using a
+// shared secret, or with RS256 using an RSA key pair.
+type TokenValidator struct {
+	alg string
+	key interface{}
+}
+
+// NewTokenValidator creates a validator for tokens signed with alg. keyFile
+// holds the shared secret for HS256, or the PEM encoded public key for RS256.
+func NewTokenValidator(alg, keyFile string) (*TokenValidator, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &TokenValidator{alg: alg}
+	switch alg {
+	case jwt.SigningMethodHS256.Alg():
+		secret := bytes.TrimSpace(data)
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("empty secret in %s", keyFile)
+		}
+		v.key = secret
+	case jwt.SigningMethodRS256.Alg():
+		var key *rsa.PublicKey
+		if key, err = jwt.ParseRSAPublicKeyFromPEM(data); err != nil {
+			return nil, err
+		}
+		v.key = key
+	default:
+		return nil, fmt.Errorf("unsupported token algorithm '%s'", alg)
+	}
+	return v, nil
+}
+
+// Validate checks the token signature and its time based claims.
+func (v *TokenValidator) Validate(token string) (*Claims, error) {
+	if token == "" {
+		return nil, ErrNoToken
+	}
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+		return v.key, nil
+	}, jwt.WithValidMethods([]string{v.alg}))
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// BearerToken extracts the token from an Authorization header value.
+func BearerToken(header string) (string, bool) {
+	const prefix = "Bearer "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(header[len(prefix):]), true
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestValidateHS256(t *testing.T) {
+	f, err := ioutil.TempFile("", "jwt-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("secret\n")
+	f.Close()
+
+	v, err := NewTokenValidator("HS256", f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(method jwt.SigningMethod, key interface{}, claims *Claims) string {
+		s, err := jwt.NewWithClaims(method, claims).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	valid := &Claims{Tenant: "acme"}
+	valid.Subject = "alice"
+	expired := &Claims{}
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+
+	claims, err := v.Validate(sign(jwt.SigningMethodHS256, []byte("secret"), valid))
+	if err != nil {
+		t.Fatalf("Valid token rejected: %v", err)
+	}
+	if claims.Subject != "alice" || claims.Tenant != "acme" {
+		t.Errorf("Unexpected claims %+v", claims)
+	}
+
+	rejected := []string{
+		"",
+		sign(jwt.SigningMethodHS256, []byte("guess"), valid),
+		sign(jwt.SigningMethodHS512, []byte("secret"), valid),
+		sign(jwt.SigningMethodHS256, []byte("secret"), expired),
+	}
+	for _, token := range rejected {
+		if _, err := v.Validate(token); err == nil {
+			t.Errorf("Token %q accepted", token)
+		}
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	if token, ok := BearerToken("bearer abc"); !ok || token != "abc" {
+		t.Errorf("BearerToken = %q, %v", token, ok)
+	}
+	if _, ok := BearerToken("Basic abc"); ok {
+		t.Errorf("Basic credentials taken as bearer token")
+	}
+}
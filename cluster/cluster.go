@@ -0,0 +1,403 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spoconnor/Go-Client-Connector/connections"
+	"github.com/spoconnor/Go-Client-Connector/contracts"
+	"github.com/spoconnor/Go-Client-Connector/tracing"
+)
+
+// Paths of the node-to-node endpoints, below the REST prefix of a node.
+const (
+	StatePath     = "/Cluster/State"
+	AnnouncePath  = "/Cluster/Announce"
+	CallPath      = "/Cluster/Call"
+	BroadcastPath = "/Cluster/Broadcast"
+	PublishPath   = "/Cluster/Publish"
+)
+
+// DefaultPrefix is the REST prefix of nodes.
+const DefaultPrefix = "/ClientConnector"
+
+// DefaultSyncInterval is how often nodes send their state to each other.
+const DefaultSyncInterval = 10 * time.Second
+
+// messageTimeout bounds messages other than calls, which use their own
+// deadline.
+const messageTimeout = 5 * time.Second
+
+// Peer is another node of the cluster.
+type Peer struct {
+	Name string
+	URL  string // REST base URL, e.g. http://127.0.0.1:9001
+}
+
+// ParsePeers parses a comma separated list of name=url pairs.
+func ParsePeers(s string) ([]Peer, error) {
+	var peers []Peer
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		i := strings.Index(p, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("peer '%s' is not name=url", p)
+		}
+		u, err := url.Parse(p[i+1:])
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("peer '%s' has no valid url", p)
+		}
+		peers = append(peers, Peer{Name: p[:i], URL: strings.TrimSuffix(p[i+1:], "/")})
+	}
+	return peers, nil
+}
+
+// Messages between nodes.
+type (
+	// StateMessage lists all keys connected to a node. A node answers it
+	// with its own state.
+	StateMessage struct {
+		Node string
+		Keys []string
+	}
+	// AnnounceMessage tells that a key connected to or disconnected from a
+	// node.
+	AnnounceMessage struct {
+		Node      string
+		Key       string
+		Connected bool
+	}
+	// CallMessage asks a node to send a request to a key connected to it.
+	// The call deadline is passed in the "timeout" query parameter.
+	CallMessage struct {
+		Key          string
+		Method       string
+		Params       contracts.RpcParams
+		WaitForReply bool
+	}
+	// BroadcastMessage asks a node to broadcast to its connections.
+	BroadcastMessage struct {
+		Method string
+		Params contracts.RpcParams
+	}
+	// PublishMessage asks a node to publish to its subscribers.
+	PublishMessage struct {
+		Topic  string
+		Method string
+		Params contracts.RpcParams
+	}
+)
+
+// Cluster routes calls to keys connected to other nodes, which are given as
+// a static list of peers. Nodes tell each other their keys with
+// announcements on every change and with a full state every SyncInterval. A
+// peer which sent nothing for three intervals is considered down. It
+// implements connections.Cluster.
+type Cluster struct {
+	node   string
+	peers  []Peer
+	secret string
+	client *http.Client
+
+	// SyncInterval is how often the state is sent to peers.
+	SyncInterval time.Duration
+	// Prefix is the REST prefix of the peers, shared by all nodes.
+	Prefix string
+
+	mu    sync.RWMutex
+	keys  map[string]map[string]struct{} // by node
+	seen  map[string]time.Time           // last message by node
+	queue map[string]chan func()         // ordered messages by node
+	done  chan struct{}
+}
+
+// New creates the cluster of node and its peers. When secret is set, nodes
+// authenticate to each other with it as a bearer token.
+func New(node string, peers []Peer, secret string) *Cluster {
+	c := &Cluster{
+		node:         node,
+		peers:        peers,
+		secret:       secret,
+		client:       &http.Client{},
+		SyncInterval: DefaultSyncInterval,
+		Prefix:       DefaultPrefix,
+		keys:         make(map[string]map[string]struct{}),
+		seen:         make(map[string]time.Time),
+		queue:        make(map[string]chan func()),
+		done:         make(chan struct{}),
+	}
+	for _, p := range peers {
+		c.queue[p.Name] = make(chan func(), 1024)
+	}
+	return c
+}
+
+// SetTLS makes requests to peers served over https use config, e.g. to
+// present the certificate of this node or to trust a private CA.
+func (c *Cluster) SetTLS(config *tls.Config) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	c.client = &http.Client{Transport: transport}
+}
+
+// Node returns the name of this node.
+func (c *Cluster) Node() string {
+	return c.node
+}
+
+// Secret returns the secret nodes authenticate with.
+func (c *Cluster) Secret() string {
+	return c.secret
+}
+
+// Start starts sending messages to peers. local returns the keys connected
+// to this node.
+func (c *Cluster) Start(local func() []string) {
+	for _, p := range c.peers {
+		go c.send(p, c.queue[p.Name])
+	}
+	go func() {
+		ticker := time.NewTicker(c.SyncInterval)
+		defer ticker.Stop()
+		for {
+			c.syncState(local())
+			select {
+			case <-c.done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop stops sending messages to peers.
+func (c *Cluster) Stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.done:
+	default:
+		close(c.done)
+	}
+}
+
+//-----------------------------------------------------------
+// connections.Cluster
+
+func (c *Cluster) Owner(key string) (string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, p := range c.peers {
+		if _, ok := c.keys[p.Name][key]; ok && c.alive(p.Name) {
+			return p.Name, true
+		}
+	}
+	return "", false
+}
+
+func (c *Cluster) Forward(
+	ctx context.Context, node, key, method string,
+	params contracts.RpcParams, waitForReply bool) (*contracts.RpcResponse, error) {
+
+	p, ok := c.peer(node)
+	if !ok {
+		return nil, connections.ErrNotConnected
+	}
+	path := CallPath
+	if deadline, ok := ctx.Deadline(); ok {
+		path += "?timeout=" + url.QueryEscape(time.Until(deadline).String())
+	}
+	var res contracts.RpcResponse
+	status, err := c.post(ctx, p, path, CallMessage{key, method, params, waitForReply}, &res)
+	if err != nil {
+		return nil, err
+	}
+	switch status {
+	case http.StatusOK:
+		if !waitForReply {
+			return nil, nil
+		}
+		return &res, nil
+	case http.StatusNotFound:
+		return nil, connections.ErrNotConnected
+	case http.StatusGatewayTimeout:
+		return nil, &connections.TimeoutError{Key: key, Method: method}
+	case http.StatusServiceUnavailable:
+		return nil, connections.ErrShuttingDown
+	}
+	return nil, fmt.Errorf("node %s answered %d", node, status)
+}
+
+func (c *Cluster) Broadcast(method string, params contracts.RpcParams) {
+	c.toAll(BroadcastPath, BroadcastMessage{method, params})
+}
+
+func (c *Cluster) Publish(topic, method string, params contracts.RpcParams) {
+	c.toAll(PublishPath, PublishMessage{topic, method, params})
+}
+
+func (c *Cluster) Announce(key string, connected bool) {
+	c.toAll(AnnouncePath, AnnounceMessage{c.node, key, connected})
+}
+
+//-----------------------------------------------------------
+// Messages from peers
+
+// ApplyState replaces the keys of the sending node. It returns false for
+// unknown nodes.
+func (c *Cluster) ApplyState(m *StateMessage) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.queue[m.Node]; !ok {
+		return false
+	}
+	keys := make(map[string]struct{}, len(m.Keys))
+	for _, k := range m.Keys {
+		keys[k] = struct{}{}
+	}
+	c.keys[m.Node] = keys
+	c.seen[m.Node] = time.Now()
+	return true
+}
+
+// ApplyAnnounce applies a key change of the sending node. It returns false
+// for unknown nodes.
+func (c *Cluster) ApplyAnnounce(m *AnnounceMessage) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.queue[m.Node]; !ok {
+		return false
+	}
+	keys := c.keys[m.Node]
+	if keys == nil {
+		keys = make(map[string]struct{})
+		c.keys[m.Node] = keys
+	}
+	if m.Connected {
+		keys[m.Key] = struct{}{}
+	} else {
+		delete(keys, m.Key)
+	}
+	c.seen[m.Node] = time.Now()
+	return true
+}
+
+//-----------------------------------------------------------
+
+// syncState sends the state of this node to every peer and applies their
+// answers.
+func (c *Cluster) syncState(keys []string) {
+	for _, p := range c.peers {
+		p := p // For closure.
+		c.enqueue(p.Name, func() {
+			ctx, cancel := context.WithTimeout(context.Background(), messageTimeout)
+			defer cancel()
+			var state StateMessage
+			status, err := c.post(ctx, p, StatePath, StateMessage{c.node, keys}, &state)
+			if err != nil || status != http.StatusOK {
+				slog.Warn("[Cluster.syncState] Sync failed", "peer", p.Name, "status", status, "err", err)
+				return
+			}
+			if state.Node != p.Name {
+				slog.Warn("[Cluster.syncState] Peer answered as another node", "peer", p.Name, "node", state.Node)
+				return
+			}
+			c.ApplyState(&state)
+		})
+	}
+}
+
+// toAll posts m to every peer, in order with other messages to the peer.
+func (c *Cluster) toAll(path string, m interface{}) {
+	for _, p := range c.peers {
+		p := p // For closure.
+		c.enqueue(p.Name, func() {
+			ctx, cancel := context.WithTimeout(context.Background(), messageTimeout)
+			defer cancel()
+			if status, err := c.post(ctx, p, path, m, nil); err != nil || status != http.StatusOK {
+				slog.Warn("[Cluster.toAll] Message failed", "peer", p.Name, "path", path, "status", status, "err", err)
+			}
+		})
+	}
+}
+
+func (c *Cluster) enqueue(node string, f func()) {
+	select {
+	case c.queue[node] <- f:
+	default:
+		slog.Warn("[Cluster.enqueue] Queue full, dropping message", "peer", node)
+	}
+}
+
+// send sends messages to p in order.
+func (c *Cluster) send(p Peer, queue <-chan func()) {
+	for {
+		select {
+		case <-c.done:
+			return
+		case f := <-queue:
+			f()
+		}
+	}
+}
+
+// post posts m as json to p and decodes a json answer into res, if not nil.
+func (c *Cluster) post(ctx context.Context, p Peer, path string, m, res interface{}) (int, error) {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest(http.MethodPost, p.URL+c.Prefix+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	tracing.ToHeader(ctx, req.Header)
+	if c.secret != "" {
+		req.Header.Set("Authorization", "Bearer "+c.secret)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode == http.StatusOK && res != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, res); err != nil {
+			return resp.StatusCode, err
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+func (c *Cluster) peer(node string) (Peer, bool) {
+	for _, p := range c.peers {
+		if p.Name == node {
+			return p, true
+		}
+	}
+	return Peer{}, false
+}
+
+// alive reports whether node sent something recently.
+// mutex must be held.
+func (c *Cluster) alive(node string) bool {
+	return time.Since(c.seen[node]) < 3*c.SyncInterval
+}
@@ -0,0 +1,114 @@
+package cluster
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/spoconnor/Go-Client-Connector/connections"
+	"github.com/spoconnor/Go-Client-Connector/contracts"
+)
+
+func TestParsePeers(t *testing.T) {
+	peers, err := ParsePeers("b=http://10.0.0.2:9000/, c=https://c:9000")
+	if err != nil || len(peers) != 2 {
+		t.Fatalf("ParsePeers returned %v, %v", peers, err)
+	}
+	if peers[0] != (Peer{"b", "http://10.0.0.2:9000"}) || peers[1] != (Peer{"c", "https://c:9000"}) {
+		t.Errorf("ParsePeers returned %v", peers)
+	}
+	for _, bad := range []string{"b", "=http://b", "b=b:9000"} {
+		if _, err := ParsePeers(bad); err == nil {
+			t.Errorf("ParsePeers(%q) returned no error", bad)
+		}
+	}
+}
+
+func TestOwner(t *testing.T) {
+	c := New("a", []Peer{{"b", "http://b"}}, "")
+	c.SyncInterval = 50 * time.Millisecond
+
+	if c.ApplyState(&StateMessage{Node: "x", Keys: []string{"Device"}}) {
+		t.Error("ApplyState accepted an unknown node")
+	}
+	c.ApplyState(&StateMessage{Node: "b", Keys: []string{"Device"}})
+	if node, ok := c.Owner("Device"); !ok || node != "b" {
+		t.Errorf("Owner returned %s, %v", node, ok)
+	}
+
+	c.ApplyAnnounce(&AnnounceMessage{Node: "b", Key: "Device", Connected: false})
+	c.ApplyAnnounce(&AnnounceMessage{Node: "b", Key: "Other", Connected: true})
+	if _, ok := c.Owner("Device"); ok {
+		t.Error("Owner found a disconnected key")
+	}
+
+	time.Sleep(3 * c.SyncInterval)
+	if _, ok := c.Owner("Other"); ok {
+		t.Error("Owner found a key of a silent node")
+	}
+}
+
+func TestForward(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var m CallMessage
+		json.NewDecoder(r.Body).Decode(&m)
+		switch m.Key {
+		case "Device":
+			json.NewEncoder(w).Encode(contracts.RpcResponse{Result: m.Method})
+		case "Slow":
+			w.WriteHeader(http.StatusGatewayTimeout)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	c := New("a", []Peer{{"b", server.URL}}, "secret")
+	ctx := context.Background()
+
+	res, err := c.Forward(ctx, "b", "Device", "Ping", nil, true)
+	if err != nil || res == nil || res.Result != "Ping" {
+		t.Errorf("Forward returned %v, %v", res, err)
+	}
+	if res, err := c.Forward(ctx, "b", "Device", "Ping", nil, false); err != nil || res != nil {
+		t.Errorf("Forward without reply returned %v, %v", res, err)
+	}
+	if _, err := c.Forward(ctx, "b", "Gone", "Ping", nil, true); err != connections.ErrNotConnected {
+		t.Errorf("Forward to a gone key returned %v", err)
+	}
+	if _, err := c.Forward(ctx, "b", "Slow", "Ping", nil, true); err == nil {
+		t.Error("Forward to a slow key returned no error")
+	} else if _, ok := err.(*connections.TimeoutError); !ok {
+		t.Errorf("Forward to a slow key returned %v", err)
+	}
+	if _, err := c.Forward(ctx, "x", "Device", "Ping", nil, true); err != connections.ErrNotConnected {
+		t.Errorf("Forward to an unknown node returned %v", err)
+	}
+}
+
+func TestForwardTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(contracts.RpcResponse{Result: "pong"})
+	}))
+	defer server.Close()
+
+	c := New("a", []Peer{{"b", server.URL}}, "secret")
+	if _, err := c.Forward(context.Background(), "b", "Device", "Ping", nil, true); err == nil {
+		t.Error("Forward trusted a peer of an unknown CA")
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	c.SetTLS(&tls.Config{RootCAs: roots})
+	if res, err := c.Forward(context.Background(), "b", "Device", "Ping", nil, true); err != nil || res.Result != "pong" {
+		t.Errorf("Forward to a trusted peer returned %v, %v", res, err)
+	}
+}
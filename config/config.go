@@ -1,5 +1,126 @@
 package config
 
+import "time"
+
+// Config holds every setting of the connector. Load reads it from a yaml or
+// json file, applies environment overrides and validates it. Restart tells
+// which changed settings need a restart to take effect.
+type Config struct {
+	Node            string          `yaml:"node"` // name of this node
+	WebSocket       WebSocketConfig `yaml:"websocket"`
+	Rest            RestConfig      `yaml:"rest"`
+	Pool            PoolConfig      `yaml:"pool"`
+	Clients         ClientsConfig   `yaml:"clients"`
+	Limits          LimitsConfig    `yaml:"limits"`
+	Auth            AuthConfig      `yaml:"auth"`
+	TLS             TLSConfig       `yaml:"tls"`
+	Store           StoreConfig     `yaml:"store"`
+	Services        ServicesConfig  `yaml:"services"`
+	Cluster         ClusterConfig   `yaml:"cluster"`
+	Webhooks        WebhookConfig   `yaml:"webhooks"`
+	TraceEndpoint   string          `yaml:"trace_endpoint"`   // otlp/http collector url, or stdout; empty disables tracing
+	LogConfig       string          `yaml:"log_config"`       // json file configuring logging
+	ShutdownTimeout time.Duration   `yaml:"shutdown_timeout"` // how long shutdown waits for in-flight work
+}
+
+// WebSocketConfig configures the websocket server.
+type WebSocketConfig struct {
+	Listen     string        `yaml:"listen"`
+	IOTimeout  time.Duration `yaml:"io_timeout"`
+	WireFormat string        `yaml:"wire_format"` // default format: "legacy" or "jsonrpc2"
+}
+
+// RestConfig configures the REST server.
+type RestConfig struct {
+	Listen      string `yaml:"listen"`
+	Prefix      string `yaml:"prefix"`       // of every route; nodes of a cluster must share it
+	ClientCA    string `yaml:"client_ca"`    // when set callers must present a certificate it signed
+	EventBuffer int    `yaml:"event_buffer"` // events kept for resuming event streams
+}
+
+// PoolConfig sizes the worker pool.
+type PoolConfig struct {
+	Workers int `yaml:"workers"`
+	Queue   int `yaml:"queue"` // tasks waiting for a worker
+}
+
+// ClientsConfig configures the handling of client connections.
+type ClientsConfig struct {
+	CallTimeout       time.Duration `yaml:"call_timeout"`       // default deadline for client replies
+	DuplicateKeys     string        `yaml:"duplicate_keys"`     // "evict", "reject" or "multiple"
+	HeartbeatInterval time.Duration `yaml:"heartbeat_interval"` // 0 disables heartbeats
+	HeartbeatMisses   int           `yaml:"heartbeat_misses"`
+	ResumeGrace       time.Duration `yaml:"resume_grace"`    // 0 disables session resumption
+	OfflineTTL        time.Duration `yaml:"offline_ttl"`     // 0 disables the offline queue
+	OfflineDepth      int           `yaml:"offline_depth"`   // notifications queued per offline key
+	TopicHistory      int           `yaml:"topic_history"`   // messages retained per topic
+	RetainedTopics    int           `yaml:"retained_topics"` // topics messages are retained on
+}
+
+// LimitsConfig rate limits the frames of every client connection. A zero
+// rate disables its limit; a zero burst is one second worth of the rate.
+type LimitsConfig struct {
+	Messages       int    `yaml:"messages"` // per second
+	MessageBurst   int    `yaml:"message_burst"`
+	Bytes          int    `yaml:"bytes"` // per second
+	ByteBurst      int    `yaml:"byte_burst"`
+	Action         string `yaml:"action"`           // "drop", "error" or "close"
+	MaxMessageSize int    `yaml:"max_message_size"` // bytes of a frame; 0 is unlimited
+}
+
+// AuthConfig configures the key handshake and bearer tokens.
+type AuthConfig struct {
+	KeySecrets    string `yaml:"key_secrets"` // json file mapping keys to handshake secrets
+	JwtAlg        string `yaml:"jwt_alg"`     // "HS256" or "RS256"
+	JwtKey        string `yaml:"jwt_key"`     // secret or public key file; empty disables tokens
+	JwtQueryParam string `yaml:"jwt_query_param"`
+}
+
+// TLSConfig selects the certificate of both servers. Empty disables tls.
+type TLSConfig struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
 type ServicesConfig struct {
-	DynamoDb string /*Uri*/
+	DynamoDb      string `yaml:"dynamodb"`       /*Uri*/
+	Region        string `yaml:"region"`         // of DynamoDb
+	RegistryTable string `yaml:"registry_table"` // DynamoDb table of the connection registry
+}
+
+// StoreConfig selects where queued messages, presence history and dead
+// letters are kept.
+type StoreConfig struct {
+	Backend string `yaml:"backend"` // "memory" or "bolt"
+	Path    string `yaml:"path"`    // database file of the bolt backend
+
+	DeadLetters int `yaml:"dead_letters"` // kept at most, the oldest are dropped
+}
+
+// ClusterConfig configures routing to other nodes.
+type ClusterConfig struct {
+	Peers        string        `yaml:"peers"`  // name=url pairs; empty disables clustering
+	Secret       string        `yaml:"secret"` // bearer token of node-to-node requests
+	SyncInterval time.Duration `yaml:"sync_interval"`
+	CA           string        `yaml:"ca"` // verifies https peers; defaults to rest.client_ca, then the system roots
+}
+
+// WebhookConfig configures the delivery of connection events.
+type WebhookConfig struct {
+	URLs     []string      `yaml:"urls"`
+	Secret   string        `yaml:"secret"`
+	Attempts int           `yaml:"attempts"`
+	Backoff  time.Duration `yaml:"backoff"` // before the first retry, doubled for every further one
+}
+
+// LoggerConfig configures logging. It is read from config/logger/logger.json.
+type LoggerConfig struct {
+	Level        string   // "debug", "info", "warn" or "error"
+	Format       string   // "json" or "text"
+	File         string   // appended to when set
+	Stderr       bool     // also log to stderr
+	Source       bool     // add the source file and line
+	Payloads     bool     // log message payloads at debug level
+	PayloadLimit int      // bytes of a logged payload; longer ones are cut
+	Redact       []string // payload fields whose values are never logged
 }
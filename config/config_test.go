@@ -0,0 +1,134 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func valid() *Config {
+	return &Config{
+		Node:            "a",
+		WebSocket:       WebSocketConfig{Listen: ":8080", IOTimeout: time.Second, WireFormat: "legacy"},
+		Rest:            RestConfig{Listen: ":9000", Prefix: "/ClientConnector", EventBuffer: 10},
+		Pool:            PoolConfig{Workers: 1},
+		Clients:         ClientsConfig{DuplicateKeys: "evict", RetainedTopics: 1},
+		Limits:          LimitsConfig{Action: "error"},
+		Auth:            AuthConfig{JwtAlg: "HS256"},
+		Store:           StoreConfig{Backend: "memory", DeadLetters: 1},
+		Webhooks:        WebhookConfig{Attempts: 1},
+		ShutdownTimeout: time.Second,
+	}
+}
+
+func write(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	if err := Load("connector.yaml", valid()); err != nil {
+		t.Errorf("shipped config: %v", err)
+	}
+
+	yaml := write(t, "c.yaml", "rest:\n  listen: \":9001\"\nclients:\n  call_timeout: 5s\nwebhooks:\n  urls: [http://a/hook]\n")
+	cfg := valid()
+	if err := Load(yaml, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Rest.Listen != ":9001" || cfg.Clients.CallTimeout != 5*time.Second || cfg.Node != "a" ||
+		!reflect.DeepEqual(cfg.Webhooks.URLs, []string{"http://a/hook"}) {
+		t.Errorf("yaml config = %+v", cfg)
+	}
+
+	json := write(t, "c.json", `{"pool": {"workers": 4}, "shutdown_timeout": "1m"}`)
+	cfg = valid()
+	if err := Load(json, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Pool.Workers != 4 || cfg.ShutdownTimeout != time.Minute {
+		t.Errorf("json config = %+v", cfg)
+	}
+
+	unknown := write(t, "c.yaml", "rest:\n  port: 9000\n")
+	if err := Load(unknown, valid()); err == nil || !strings.Contains(err.Error(), "port") {
+		t.Errorf("unknown setting error = %v", err)
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"CONNECTOR_NODE":                    "b",
+		"CONNECTOR_POOL_WORKERS":            "7",
+		"CONNECTOR_CLIENTS_RESUME_GRACE":    "1m",
+		"CONNECTOR_WEBHOOKS_URLS":           "http://a, http://b",
+		"CONNECTOR_SERVICES_REGISTRY_TABLE": "t",
+	}
+	cfg := valid()
+	err := applyEnv(cfg, func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Node != "b" || cfg.Pool.Workers != 7 || cfg.Clients.ResumeGrace != time.Minute ||
+		cfg.Services.RegistryTable != "t" || !reflect.DeepEqual(cfg.Webhooks.URLs, []string{"http://a", "http://b"}) {
+		t.Errorf("config = %+v", cfg)
+	}
+
+	err = applyEnv(valid(), func(name string) (string, bool) { return "x", name == "CONNECTOR_POOL_QUEUE" })
+	if err == nil || !strings.HasPrefix(err.Error(), "CONNECTOR_POOL_QUEUE") {
+		t.Errorf("bad value error = %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := valid().Validate(); err != nil {
+		t.Fatal(err)
+	}
+	cfg := valid()
+	cfg.WebSocket.WireFormat = "xml"
+	cfg.Rest.Prefix = "/api/"
+	cfg.Rest.ClientCA = "ca.pem"
+	cfg.Pool.Workers = 0
+	cfg.TLS.Key = "key.pem"
+	cfg.Webhooks.URLs = []string{"ftp://a"}
+	cfg.Clients.DuplicateKeys = "keep"
+	cfg.Limits.Action = "ignore"
+	cfg.Auth.JwtAlg = "none"
+	cfg.Store.Backend = "redis"
+	cfg.Cluster.Peers = "b=http://b:9000"
+	cfg.Cluster.SyncInterval = time.Second
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("no error")
+	}
+	for _, setting := range []string{"websocket.wire_format", "rest.prefix", "rest.client_ca", "pool.workers", "tls:", "webhooks.urls",
+		"clients.duplicate_keys", "limits.action", "auth.jwt_alg", "store.backend", "cluster.secret"} {
+		if !strings.Contains(err.Error(), setting) {
+			t.Errorf("no %s error in %v", setting, err)
+		}
+	}
+}
+
+func TestRestart(t *testing.T) {
+	cfg, next := valid(), valid()
+	next.Webhooks.URLs = []string{"http://a"}
+	next.LogConfig = "other.json"
+	next.Limits.Messages = 10
+	if changed := cfg.Restart(next); len(changed) != 0 {
+		t.Errorf("reloadable settings need a restart: %v", changed)
+	}
+	next.Rest.Listen = ":9001"
+	next.Pool.Workers = 2
+	if changed := cfg.Restart(next); !reflect.DeepEqual(changed, []string{"pool.workers", "rest.listen"}) {
+		t.Errorf("changed = %v", changed)
+	}
+}
@@ -0,0 +1,229 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spoconnor/Go-Client-Connector/contracts"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix prefixes the environment variables overriding settings. A
+// variable is named after the yaml path of its setting in upper case, joined
+// by "_", e.g. CONNECTOR_REST_LISTEN or CONNECTOR_CLIENTS_CALL_TIMEOUT.
+// Lists are comma separated.
+const EnvPrefix = "CONNECTOR_"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Load reads the yaml or json file at path over cfg, which holds the
+// defaults, applies environment overrides and validates the result. An empty
+// path reads no file. Unknown settings in the file are an error.
+func Load(path string, cfg *Config) error {
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		d := yaml.NewDecoder(bytes.NewReader(data))
+		d.KnownFields(true)
+		if err := d.Decode(cfg); err != nil && err != io.EOF {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+	}
+	if err := applyEnv(cfg, os.LookupEnv); err != nil {
+		return err
+	}
+	return cfg.Validate()
+}
+
+// Validate checks the settings, reporting every invalid one.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, setting, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(setting+": "+format, args...))
+		}
+	}
+	check(c.Node != "", "node", "must be set")
+
+	check(c.WebSocket.Listen != "", "websocket.listen", "must be set")
+	check(c.WebSocket.IOTimeout > 0, "websocket.io_timeout", "must be positive")
+	_, err := contracts.ParseWireFormat(c.WebSocket.WireFormat)
+	check(err == nil, "websocket.wire_format", "%v", err)
+
+	check(c.Rest.Listen != "", "rest.listen", "must be set")
+	check(strings.HasPrefix(c.Rest.Prefix, "/") && !strings.HasSuffix(c.Rest.Prefix, "/"),
+		"rest.prefix", "'%s' must start and must not end with '/'", c.Rest.Prefix)
+	check(c.Rest.ClientCA == "" || c.TLS.Cert != "", "rest.client_ca", "requires tls.cert and tls.key")
+	check(c.Rest.EventBuffer > 0, "rest.event_buffer", "must be positive")
+
+	check(c.Pool.Workers > 0, "pool.workers", "must be positive")
+	check(c.Pool.Queue >= 0, "pool.queue", "must not be negative")
+
+	check(oneOf(c.Clients.DuplicateKeys, "evict", "reject", "multiple"),
+		"clients.duplicate_keys", "'%s' is not evict, reject or multiple", c.Clients.DuplicateKeys)
+	check(c.Clients.CallTimeout >= 0, "clients.call_timeout", "must not be negative")
+	check(c.Clients.HeartbeatInterval >= 0, "clients.heartbeat_interval", "must not be negative")
+	check(c.Clients.HeartbeatInterval == 0 || c.Clients.HeartbeatMisses > 0, "clients.heartbeat_misses", "must be positive")
+	check(c.Clients.ResumeGrace >= 0, "clients.resume_grace", "must not be negative")
+	check(c.Clients.OfflineTTL >= 0, "clients.offline_ttl", "must not be negative")
+	check(c.Clients.OfflineTTL == 0 || c.Clients.OfflineDepth > 0, "clients.offline_depth", "must be positive")
+	check(c.Clients.TopicHistory >= 0, "clients.topic_history", "must not be negative")
+	check(c.Clients.RetainedTopics > 0, "clients.retained_topics", "must be positive")
+
+	check(c.Limits.Messages >= 0, "limits.messages", "must not be negative")
+	check(c.Limits.MessageBurst >= 0, "limits.message_burst", "must not be negative")
+	check(c.Limits.Bytes >= 0, "limits.bytes", "must not be negative")
+	check(c.Limits.ByteBurst >= 0, "limits.byte_burst", "must not be negative")
+	check(c.Limits.MaxMessageSize >= 0, "limits.max_message_size", "must not be negative")
+	check(oneOf(c.Limits.Action, "drop", "error", "close"),
+		"limits.action", "'%s' is not drop, error or close", c.Limits.Action)
+
+	check(oneOf(c.Auth.JwtAlg, "HS256", "RS256"), "auth.jwt_alg", "'%s' is not HS256 or RS256", c.Auth.JwtAlg)
+
+	check((c.TLS.Cert == "") == (c.TLS.Key == ""), "tls", "cert and key must be set together")
+
+	check(oneOf(c.Store.Backend, "memory", "bolt"), "store.backend", "'%s' is not memory or bolt", c.Store.Backend)
+	check(c.Store.Backend != "bolt" || c.Store.Path != "", "store.path", "must be set for the bolt backend")
+	check(c.Store.DeadLetters > 0, "store.dead_letters", "must be positive")
+
+	check(c.Cluster.Peers == "" || c.Cluster.Secret != "", "cluster.secret", "must be set with cluster.peers")
+	check(c.Cluster.Peers == "" || c.Cluster.SyncInterval > 0, "cluster.sync_interval", "must be positive")
+
+	for _, u := range c.Webhooks.URLs {
+		parsed, err := url.Parse(u)
+		check(err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != "",
+			"webhooks.urls", "'%s' is not an http url", u)
+	}
+	check(len(c.Webhooks.URLs) == 0 || c.Webhooks.Attempts > 0, "webhooks.attempts", "must be positive")
+	check(c.Webhooks.Backoff >= 0, "webhooks.backoff", "must not be negative")
+
+	check(c.ShutdownTimeout > 0, "shutdown_timeout", "must be positive")
+	return errors.Join(errs...)
+}
+
+func oneOf(s string, values ...string) bool {
+	for _, v := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Restart returns the settings which differ in next and take effect only on
+// restart. The rate limits, webhook urls and the log config are applied when
+// reloaded.
+func (c *Config) Restart(next *Config) []string {
+	reloadable := func(cfg Config) Config {
+		cfg.Limits = LimitsConfig{}
+		cfg.Webhooks.URLs = nil
+		cfg.LogConfig = ""
+		return cfg
+	}
+	current := values(reloadable(*c))
+	var changed []string
+	for setting, v := range values(reloadable(*next)) {
+		if !reflect.DeepEqual(current[setting], v) {
+			changed = append(changed, setting)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// values returns the settings of cfg by yaml path.
+func values(cfg Config) map[string]interface{} {
+	m := make(map[string]interface{})
+	settings(reflect.ValueOf(&cfg).Elem(), nil, func(path []string, v reflect.Value) error {
+		m[strings.Join(path, ".")] = v.Interface()
+		return nil
+	})
+	return m
+}
+
+// applyEnv sets the settings of cfg which have an environment variable.
+func applyEnv(cfg *Config, lookup func(string) (string, bool)) error {
+	return settings(reflect.ValueOf(cfg).Elem(), nil, func(path []string, v reflect.Value) error {
+		name := EnvPrefix + strings.ToUpper(strings.Join(path, "_"))
+		s, ok := lookup(name)
+		if !ok {
+			return nil
+		}
+		if err := setValue(v, s); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		return nil
+	})
+}
+
+// settings calls f with the yaml path and value of every setting of v.
+func settings(v reflect.Value, path []string, f func([]string, reflect.Value) error) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		p := append(path[:len(path):len(path)], name)
+		if field := v.Field(i); field.Kind() == reflect.Struct {
+			if err := settings(field, p, f); err != nil {
+				return err
+			}
+		} else if err := f(p, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setValue parses s into the setting v.
+func setValue(v reflect.Value, s string) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		var list []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+	return nil
+}
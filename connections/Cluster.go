@@ -0,0 +1,32 @@
+package connections
+
+import (
+	"context"
+
+	"github.com/spoconnor/Go-Client-Connector/contracts"
+)
+
+// Cluster connects a ConnectionsManager to the other nodes of a cluster.
+type Cluster interface {
+	// Owner returns another node the key is connected to.
+	Owner(key string) (node string, ok bool)
+	// Forward runs SendToLocalClient on node and relays its reply.
+	Forward(ctx context.Context, node, key, method string,
+		params contracts.RpcParams, waitForReply bool) (*contracts.RpcResponse, error)
+	// Broadcast runs BroadcastLocal on the other nodes.
+	Broadcast(method string, params contracts.RpcParams)
+	// Publish runs PublishLocal on the other nodes.
+	Publish(topic, method string, params contracts.RpcParams)
+	// Announce tells the other nodes that key connected to or disconnected
+	// from this node.
+	Announce(key string, connected bool)
+}
+
+// remoteOwner returns the node key is connected to, when it is not
+// connected to this node but to another node of the cluster.
+func (c *ConnectionsManager) remoteOwner(key string) (string, bool) {
+	if c.Cluster == nil || c.HaveConnectionKey(key) {
+		return "", false
+	}
+	return c.Cluster.Owner(key)
+}
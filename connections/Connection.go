@@ -2,18 +2,27 @@ package connections
 
 import (
 	"bufio"
-	"bytes"
-	"encoding/json"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
+	"log/slog"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/spoconnor/Go-Client-Connector/contracts"
+	"github.com/spoconnor/Go-Client-Connector/logging"
+	"github.com/spoconnor/Go-Client-Connector/metrics"
+	"github.com/spoconnor/Go-Client-Connector/tracing"
 
 	"github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsutil"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Connection represents user connection.
@@ -34,75 +43,244 @@ type Connection struct {
 
 	Properties map[string]string
 
-	awaitingReply map[int](chan *contracts.RpcResponse)
+	format     contracts.WireFormat
+	nonce      string // sent with the key request, signed by the client
+	remoteAddr string
+
+	topics map[string]struct{} // guarded by the ConnectionsManager mutex
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	ctx       context.Context    // of request handlers, canceled on close and on shutdown
+	cancel    context.CancelFunc // of ctx
+	onClose   []func()
+
+	endOnce sync.Once
+	ended   chan struct{} // closed when the session ends or is resumed
+
+	mu            sync.Mutex // guards awaitingReply, session, heartbeat and rate limit state
+	awaitingReply map[int]awaiting
+	resumeToken   string
+	successor     *Connection   // resumed the session
+	lastSeen      time.Time     // last frame received
+	roundTrip     time.Duration // of the last answered ping
+
+	messages    tokenBucket // rate limit buckets, guarded by mu
+	bytes       tokenBucket
+	rateLimited int64 // messages which exceeded a rate limit
+}
+
+// ConnectionInfo describes a connection for REST callers.
+type ConnectionInfo struct {
+	Key          string
+	ConnectionId string
+	RemoteAddr   string
+	Connected    time.Time
+	WireFormat   string
+	Properties   map[string]string
+	LastSeen     time.Time
+	RoundTripMs  float64 // zero until a heartbeat ping is answered
+	RateLimited  int64   // messages which exceeded a rate limit
+}
+
+// logger returns a logger with the key, connection id and remote address of
+// the connection.
+func (u *Connection) logger() *slog.Logger {
+	l := slog.Default().With(logging.ConnectionIdAttr, u.ConnectionId, logging.RemoteAddrAttr, u.remoteAddr)
+	if u.Key != "" {
+		l = l.With(logging.KeyAttr, u.Key)
+	}
+	return l
+}
+
+// debug logs at debug level with the connection fields, when enabled.
+func (u *Connection) debug(msg string, args ...interface{}) {
+	if slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		u.logger().Debug(msg, args...)
+	}
+}
+
+func (u *Connection) Info() ConnectionInfo {
+	u.mu.Lock()
+	lastSeen, roundTrip, rateLimited := u.lastSeen, u.roundTrip, u.rateLimited
+	u.mu.Unlock()
+	return ConnectionInfo{
+		Key:          u.Key,
+		ConnectionId: u.ConnectionId,
+		RemoteAddr:   u.remoteAddr,
+		Connected:    u.DateTimeUtc,
+		WireFormat:   u.format.String(),
+		Properties:   u.Properties,
+		LastSeen:     lastSeen,
+		RoundTripMs:  float64(roundTrip) / float64(time.Millisecond),
+		RateLimited:  rateLimited,
+	}
 }
 
+// OnClose registers f to be called when the connection is closed.
+// It must be called before the connection is served.
+func (u *Connection) OnClose(f func()) {
+	u.onClose = append(u.onClose, f)
+}
+
+// Close closes the underlying connection and runs OnClose callbacks.
+// Unless the session can be resumed, calls awaiting replies fail.
+// It is safe to call Close more than once.
+func (u *Connection) Close() error {
+	var err error
+	u.closeOnce.Do(func() {
+		close(u.closed)
+		u.cancel()
+		if u.token() == "" {
+			u.end(nil)
+		}
+		err = u.conn.Close()
+		for _, f := range u.onClose {
+			f()
+		}
+	})
+	return err
+}
+
+// SendKeyRequest asks the client for its key. The request carries a fresh
+// nonce, which the client has to sign with the secret of its key.
 func (u *Connection) SendKeyRequest() error {
-	log.Printf("Sending Key request")
-	var buf bytes.Buffer
-	w := wsutil.NewWriter(&buf, ws.StateServerSide, ws.OpBinary)
-	w.Write([]byte(KeyPlease))
-	if err := w.Flush(); err != nil {
-		log.Printf("[SendKeyRequest] Error: %s", err)
-		u.conn.Close()
+	u.debug("[SendKeyRequest] Sending key request")
+	nonce, err := newNonce()
+	if err != nil {
+		u.logger().Warn("[SendKeyRequest] Error", "err", err)
+		u.Close()
 		return err
 	}
-	log.Printf("[SendKeyRequest] Writing key request...")
-	return u.writeRaw(buf.Bytes())
+	u.nonce = nonce
+
+	u.debug("[SendKeyRequest] Writing key request")
+	if err := u.writeBinary([]byte(KeyPlease + ":" + nonce)); err != nil {
+		u.logger().Warn("[SendKeyRequest] Error", "err", err)
+		u.Close()
+		return err
+	}
+	return nil
 }
 
 // Receive reads next message from user's underlying connection.
 // It blocks until full message received.
 func (u *Connection) Receive() error {
-	res, err := u.readResponse()
+	in, err := u.readResponse()
 	if err != nil {
-		log.Printf("[Receive] Error: %s", err)
-		u.conn.Close()
+		u.logger().Info("[Connection.Receive] Closing", "err", err)
+		u.Close()
 		return err
 	}
-	if res == nil {
+	if in.handshake != nil {
+		return u.completeHandshake(in.handshake)
+	}
+	if in.tooBig {
+		u.writeClose(ws.StatusMessageTooBig, "Message too big")
+		u.Close()
+		return ErrMessageTooBig
+	}
+	if in.limited && in.action == CloseConnection {
+		u.writeClose(ws.StatusPolicyViolation, "Rate limit exceeded")
+		u.Close()
+		return ErrRateLimited
+	}
+	if in.limited {
+		if !in.reply {
+			return nil
+		}
+		return u.writeReplies([]*contracts.RpcResponse{{
+			ID:    contracts.NullId,
+			Error: contracts.NewRpcError(contracts.ServerError, "rate limit exceeded"),
+		}}, false)
+	}
+	if in.msgs == nil {
 		// Handled some control message.
 		return nil
 	}
-	log.Printf("[Connection.Receive] Received response %v", res.Result)
-	/*
-		switch req.Method {
-		case "rename":
-			name, ok := req.Params["name"].(string)
-			if !ok {
-				return u.writeErrorTo(req, websockets.Params{
-					"error": "bad params",
-				})
-			}
-			prev, ok := u.ConnectionsManager.Rename(u, name)
-			if !ok {
-				return u.writeErrorTo(req, websockets.Params{
-					"error": "already exists",
-				})
+	if !u.connectionsManager.isRegistered(u) {
+		return u.refuse(errors.New("message before key handshake"))
+	}
+
+	msgs, batch := in.msgs, in.batch
+	var replies []*contracts.RpcResponse
+	var requests []*contracts.RpcRequest
+	for _, m := range msgs {
+		switch {
+		case m.Response != nil:
+			logging.Message(u.logger(), "[Connection.Receive] Received response", m.Response.Result, "id", m.Response.ID.String())
+			u.deliverReply(m.Response, in.received)
+		case m.Error != nil:
+			u.logger().Warn("[Connection.Receive] Invalid message", "err", m.Error.Message)
+			replies = append(replies, &contracts.RpcResponse{ID: m.ErrorId, Error: m.Error})
+		case m.Request != nil:
+			logging.Message(u.logger(), "[Connection.Receive] Received request", m.Request.Params, "method", m.Request.Method)
+			requests = append(requests, m.Request)
+		}
+	}
+	if len(requests) == 0 {
+		return u.writeReplies(replies, batch)
+	}
+	return u.dispatch(requests, replies, batch)
+}
+
+// dispatch runs handlers of client requests on the pool and writes their
+// results after the given replies. Requests of one batch are handled in
+// order and answered with a single batch.
+func (u *Connection) dispatch(requests []*contracts.RpcRequest, replies []*contracts.RpcResponse, batch bool) error {
+	c := u.connectionsManager
+	err := c.pool.ScheduleTimeout(dispatchTimeout, func() {
+		for _, req := range requests {
+			res := c.Methods.call(u.ctx, u, req)
+			if !req.ID.IsAbsent() {
+				replies = append(replies, res)
 			}
-			u.ConnectionsManager.Broadcast("rename", websockets.Params{
-				"prev": prev,
-				"name": name,
-				"time": timestamp(),
-			})
-			return u.writeResultTo(req, nil)
-		case "publish":
-			req.Params["author"] = u.name
-			req.Params["time"] = timestamp()
-			u.ConnectionsManager.Broadcast("publish", req.Params)
-		default:
-			return u.writeErrorTo(req, websockets.Params{
-				"error": "not implemented",
+		}
+		if err := u.writeReplies(replies, batch); err != nil {
+			u.logger().Warn("[Connection.dispatch] Error", "err", err)
+		}
+	})
+	if err == nil {
+		return nil
+	}
+
+	u.logger().Warn("[Connection.dispatch] Server busy", "err", err)
+	for _, req := range requests {
+		if !req.ID.IsAbsent() {
+			replies = append(replies, &contracts.RpcResponse{
+				ID:    req.ID,
+				Error: contracts.NewRpcError(contracts.ServerError, "server busy"),
 			})
 		}
-	*/
-	return nil
+	}
+	return u.writeReplies(replies, batch)
 }
 
 //------------------------------------------------------------------
 
-// readResponse reads json-rpc response from connection.
-func (u *Connection) readResponse() (*contracts.RpcResponse, error) {
+// inbound is what readResponse read from the connection.
+type inbound struct {
+	handshake *handshake
+	msgs      []contracts.RpcMessage
+	batch     bool      // msgs came as a JSON-RPC 2.0 batch
+	received  time.Time // when the frame header of msgs was read
+	limited   bool      // the frame exceeded a rate limit and was discarded
+	action    RateLimitAction
+	reply     bool // answer the limited frame with a ServerError
+	tooBig    bool // the frame exceeded the maximum message size
+}
+
+// handshake is the client answer to the key request.
+type handshake struct {
+	key    string
+	proof  string
+	resume string // token of a session to resume
+}
+
+// readResponse reads next frame from connection. Binary frames carry the
+// key handshake; text frames are decoded into json-rpc messages according to
+// the connection wire format.
+func (u *Connection) readResponse() (*inbound, error) {
 	u.io.Lock()
 	defer u.io.Unlock()
 
@@ -110,107 +288,348 @@ func (u *Connection) readResponse() (*contracts.RpcResponse, error) {
 	if err != nil {
 		return nil, err
 	}
+	countFrame(metrics.In, h.OpCode, h.Length)
+	u.seen()
+	if u.tooBig(h.Length) {
+		return &inbound{tooBig: true}, nil
+	}
+	// Close frames are always handled, other frames exceeding a limit are
+	// discarded unread.
+	received := time.Now()
+	action, allowed := u.allow(h.Length, received)
+	if !allowed && action == CloseConnection {
+		return &inbound{limited: true, action: action}, nil
+	}
+	if !allowed && h.OpCode != ws.OpClose {
+		_, err := io.CopyN(ioutil.Discard, r, h.Length)
+		return &inbound{limited: true, action: action, reply: action == ReplyError && h.OpCode == ws.OpText}, err
+	}
+
+	if h.OpCode == ws.OpPong {
+		payload, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		u.pong(payload)
+		return &inbound{}, nil
+	}
 	if h.OpCode.IsControl() {
-		return nil, wsutil.ControlHandler(u.conn, ws.StateServerSide)(h, r)
+		return &inbound{}, wsutil.ControlHandler(u.conn, ws.StateServerSide)(h, r)
 	}
 
 	if h.OpCode == ws.OpBinary {
 
-		log.Printf("Received binary")
+		u.debug("[Connection.readResponse] Received binary")
 		reader := bufio.NewReader(r)
 		message, err := reader.ReadString('\n')
-		log.Printf("Received %s", message)
 		challenge, err := reader.ReadString('\n')
-		log.Printf("Received %s", challenge)
-
-		key := strings.TrimSpace(strings.TrimPrefix(message, KeyPrefix))
-		u.connectionsManager.SetConnectionKey(u, key)
+		u.debug("[Connection.readResponse] Received handshake", "claimed", strings.TrimSpace(strings.TrimPrefix(message, KeyPrefix)))
+		resume := ""
+		if err == nil {
+			resume, err = reader.ReadString('\n')
+		}
 
 		if err == io.EOF {
 			err = nil
 		}
-		return nil, err
+		return &inbound{handshake: &handshake{
+			key:    strings.TrimSpace(strings.TrimPrefix(message, KeyPrefix)),
+			proof:  strings.TrimSpace(strings.TrimPrefix(challenge, ProofPrefix)),
+			resume: strings.TrimSpace(strings.TrimPrefix(resume, ResumePrefix)),
+		}}, err
 	}
 	if h.OpCode == ws.OpText {
-		log.Printf("Received text")
-		res := &contracts.RpcResponse{}
-		decoder := json.NewDecoder(r)
-		if err := decoder.Decode(res); err != nil {
-			log.Printf("[Receive] Json decode response error: %s", err)
+		u.debug("[Connection.readResponse] Received text", "bytes", h.Length)
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
 			return nil, err
 		}
+		msgs, batch := u.format.Decode(data)
+		return &inbound{msgs: msgs, batch: batch, received: received}, nil
+	}
 
-		c, has := u.awaitingReply[res.ID]
-		if has {
-			log.Println("[Connection.readReasponse] notifying of response")
+	u.logger().Warn("[Connection.readResponse] Unhandled opcode", "opcode", h.OpCode)
+	_, err = io.CopyN(ioutil.Discard, r, h.Length)
+	return &inbound{}, err // TODO - error
+}
 
-			c <- res
+// completeHandshake verifies the client proof and registers the connection
+// under its key. Connections failing verification are refused.
+func (u *Connection) completeHandshake(hs *handshake) error {
+	c := u.connectionsManager
+	if c.isRegistered(u) {
+		return u.refuse(errors.New("repeated key handshake"))
+	}
+	if hs.key == "" {
+		return u.refuse(errors.New("empty key"))
+	}
+	if bound, ok := u.Properties[KeyProperty]; ok && bound != hs.key {
+		return u.refuse(fmt.Errorf("key '%s' claimed, connection is bound to '%s'", hs.key, bound))
+	}
+	if err := verifyProof(c.Secrets, u.nonce, hs.key, hs.proof); err != nil {
+		return u.refuse(fmt.Errorf("key '%s' not verified: %s", hs.key, err))
+	}
+	if hs.resume != "" {
+		resumed, err := c.resume(u, hs.key, hs.resume)
+		if err != nil {
+			return u.refuse(fmt.Errorf("key '%s' not resumed: %s", hs.key, err))
+		}
+		if resumed {
+			return nil
+		}
+		u.logger().Info("[Connection.completeHandshake] Session can not be resumed", "claimed", hs.key)
+	}
+	if err := c.SetConnectionKey(u, hs.key); err != nil {
+		return u.refuse(fmt.Errorf("key '%s' not registered: %s", hs.key, err))
+	}
+	return nil
+}
+
+// refuse tells the client it is Forbidden and closes the connection.
+// It returns an error describing the reason, for the caller to stop serving
+// the connection.
+func (u *Connection) refuse(reason error) error {
+	u.logger().Warn("[Connection.refuse] Refused", "reason", reason)
+	u.writeBinary([]byte(Forbidden))
+	u.writeClose(ws.StatusPolicyViolation, Forbidden)
+	u.Close()
+	return reason
+}
+
+// awaiting is a call waiting for its reply.
+type awaiting struct {
+	reply chan *contracts.RpcResponse
+	span  trace.SpanContext // of the call, parent of the span reading the reply
+}
+
+// deliverReply hands a response, read at received, over to the call awaiting
+// it, if any.
+func (u *Connection) deliverReply(res *contracts.RpcResponse, received time.Time) {
+	id, ok := res.ID.Int()
+	if !ok {
+		u.logger().Warn("[Connection.deliverReply] Unexpected response id", "id", res.ID.String())
+		return
+	}
+	u.mu.Lock()
+	a, has := u.awaitingReply[id]
+	delete(u.awaitingReply, id)
+	u.mu.Unlock()
+	if has {
+		u.debug("[Connection.deliverReply] Notifying of response", "id", id)
+		if a.span.IsValid() {
+			ctx := trace.ContextWithSpanContext(context.Background(), a.span)
+			_, span := tracing.Start(ctx, "Connection.readResponse", trace.WithTimestamp(received))
+			defer span.End()
+		}
+		// Reply channels are buffered, so this never blocks the reader.
+		a.reply <- res
+	}
+}
+
+// expectReply registers interest in the response with the given id, for the
+// call traced by ctx. It must be called before the request is written, so
+// that a fast reply is not missed.
+func (u *Connection) expectReply(ctx context.Context, id int) <-chan *contracts.RpcResponse {
+	c := make(chan *contracts.RpcResponse, 1)
+	u.mu.Lock()
+	u.awaitingReply[id] = awaiting{reply: c, span: trace.SpanContextFromContext(ctx)}
+	u.mu.Unlock()
+	return c
+}
+
+// cancelReply forgets about the response with the given id.
+func (u *Connection) cancelReply(id int) {
+	u.mu.Lock()
+	delete(u.awaitingReply, id)
+	u.mu.Unlock()
+}
+
+// AwaitReply blocks until the response registered by expectReply arrives or
+// ctx is done. The awaiting entry is always cleaned up before returning.
+// When ctx deadline expires a *TimeoutError is returned; calls still waiting
+// when the session ends or the manager shuts down fail at once. When the
+// session is resumed the reply is awaited from the new connection.
+func (u *Connection) AwaitReply(ctx context.Context, id int, reply <-chan *contracts.RpcResponse) (*contracts.RpcResponse, error) {
+	u.debug("[Connection.AwaitReply] Waiting", "id", id)
+	current := u
+	defer func() { current.cancelReply(id) }()
+
+	for {
+		select {
+		case res := <-reply:
+			logging.Message(u.logger(), "[Connection.AwaitReply] Returning response", res, "id", id)
+			return res, nil
+		case <-u.connectionsManager.done:
+			return nil, ErrShuttingDown
+		case <-current.ended:
+			next := current.next()
+			if next == nil {
+				return nil, ErrConnectionClosed
+			}
+			current = next
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return nil, &TimeoutError{Key: u.Key, ID: id}
+			}
+			return nil, ctx.Err()
 		}
-		delete(u.awaitingReply, res.ID)
-		return res, nil
 	}
+}
 
-	log.Printf("[Receive] Unhandled OpCode received %d", h.OpCode)
-	return nil, nil // TODO - error
+// Call writes the raw request frame with the given id and waits for the
+// client's reply.
+func (u *Connection) Call(ctx context.Context, id int, frame []byte) (*contracts.RpcResponse, error) {
+	return u.call(ctx, id, "", frame)
 }
 
-func (u *Connection) AwaitReply(id int) (*contracts.RpcResponse, error) {
-	log.Println("[Connection.AwaitReply] waiting")
-	c := make(chan *contracts.RpcResponse)
-	u.awaitingReply[id] = c
-	res := <-c
-	log.Printf("[Connection.AwaitReply] returning response %v", res)
-	return res, nil
+// call is Call for a request of method, telling event listeners about it.
+func (u *Connection) call(ctx context.Context, id int, method string, frame []byte) (*contracts.RpcResponse, error) {
+	c := u.connectionsManager
+	reply := u.expectReply(ctx, id)
+	if err := u.writeTraced(ctx, frame); err != nil {
+		u.cancelReply(id)
+		return nil, err
+	}
+	c.emitRpc(RpcSentEvent, u, method, id)
+	res, err := u.AwaitReply(ctx, id, reply)
+	c.replied(u, method, id, res, err)
+	return res, err
 }
 
-func (u *Connection) writeErrorTo(req *contracts.RpcRequest, message string) error {
-	log.Println("[writeError]")
-	return u.write(contracts.RpcResponse{
-		ID: req.ID,
-		Error: contracts.RpcError{
-			Message: message,
-		},
+// writeErrorTo answers the request of id with an error.
+func (u *Connection) writeErrorTo(id contracts.RpcId, rpcErr *contracts.RpcError) error {
+	u.debug("[Connection.writeErrorTo] Writing error", "code", rpcErr.Code)
+	return u.writeResponse(&contracts.RpcResponse{
+		ID:    id,
+		Error: rpcErr,
 	})
 }
 
-func (u *Connection) writeResultTo(req *contracts.RpcRequest, result contracts.RpcParams) error {
-	log.Println("[writeResultTo]")
-	return u.write(contracts.RpcResponse{
-		ID:     req.ID,
+// writeResultTo answers the request of id with a result.
+func (u *Connection) writeResultTo(id contracts.RpcId, result interface{}) error {
+	u.debug("[Connection.writeResultTo] Writing result")
+	return u.writeResponse(&contracts.RpcResponse{
+		ID:     id,
 		Result: result,
 	})
 }
 
 func (u *Connection) writeNotice(method string, params contracts.RpcParams) error {
-	log.Println("[writeNotice]")
-	return u.write(contracts.RpcRequest{
+	logging.Message(u.logger(), "[Connection.writeNotice] Writing notice", params, "method", method)
+	p, err := u.format.EncodeRequest(&contracts.RpcRequest{
 		Method: method,
 		Params: params,
 	})
+	if err != nil {
+		return err
+	}
+	return u.write(p)
 }
 
-func (u *Connection) write(x interface{}) error {
-	log.Println("[write] Writing interface")
+func (u *Connection) writeResponse(res *contracts.RpcResponse) error {
+	p, err := u.format.EncodeResponse(res)
+	if err != nil {
+		return err
+	}
+	return u.write(p)
+}
+
+// writeReplies writes responses to received messages, as a batch when the
+// messages came as one, else each by writeResultTo or writeErrorTo.
+func (u *Connection) writeReplies(replies []*contracts.RpcResponse, batch bool) error {
+	if len(replies) == 0 {
+		return nil
+	}
+	if batch {
+		p, err := u.format.EncodeBatch(replies)
+		if err != nil {
+			return err
+		}
+		return u.write(p)
+	}
+	for _, res := range replies {
+		var err error
+		if res.Error != nil {
+			err = u.writeErrorTo(res.ID, res.Error)
+		} else {
+			err = u.writeResultTo(res.ID, res.Result)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write writes an encoded message as a single text frame.
+func (u *Connection) write(p []byte) error {
+	u.debug("[Connection.write] Writing message", "bytes", len(p))
 	w := wsutil.NewWriter(u.conn, ws.StateServerSide, ws.OpText)
-	encoder := json.NewEncoder(w)
 
 	u.io.Lock()
 	defer u.io.Unlock()
 
-	if err := encoder.Encode(x); err != nil {
+	if _, err := w.Write(p); err != nil {
 		return err
 	}
+	countFrame(metrics.Out, ws.OpText, int64(len(p)))
 
 	return w.Flush()
 }
 
+// writeBinary writes p as a single binary frame.
+func (u *Connection) writeBinary(p []byte) error {
+	frame, err := ws.CompileFrame(ws.NewBinaryFrame(p))
+	if err != nil {
+		return err
+	}
+	return u.writeRaw(frame)
+}
+
+// writeClose writes a close frame with the given status and reason.
+func (u *Connection) writeClose(code ws.StatusCode, reason string) error {
+	frame, err := ws.CompileFrame(ws.NewCloseFrame(ws.NewCloseFrameBody(code, reason)))
+	if err != nil {
+		return err
+	}
+	return u.writeRaw(frame)
+}
+
+// writeTraced is writeRaw in a span of the request traced by ctx.
+func (u *Connection) writeTraced(ctx context.Context, p []byte) error {
+	_, span := tracing.Start(ctx, "Connection.writeRaw", trace.WithAttributes(attribute.Int("connector.bytes", len(p))))
+	err := u.writeRaw(p)
+	tracing.End(span, err)
+	return err
+}
+
 func (u *Connection) writeRaw(p []byte) error {
-	log.Printf("[writeRaw] Writing %d raw bytes", len(p))
+	u.debug("[Connection.writeRaw] Writing", "bytes", len(p))
 	u.io.Lock()
 	defer u.io.Unlock()
 
 	count, err := u.conn.Write(p)
-	log.Printf("[writeRaw] Wrote %d bytes", count)
+	u.debug("[Connection.writeRaw] Wrote", "bytes", count)
+	if err == nil {
+		countFrames(metrics.Out, p)
+	}
 
 	return err
 }
+
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// newConnectionId returns a random guid formatted id.
+func newConnectionId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40 // Version 4.
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant.
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -1,63 +1,208 @@
 package connections
 
 import (
-	"bytes"
-	"encoding/json"
-	"log"
+	"container/list"
+	"context"
+	"log/slog"
 	"net"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/spoconnor/Go-Client-Connector/contracts"
-	"github.com/spoconnor/Go-Common-Code/gopool"
+	"github.com/spoconnor/Go-Client-Connector/logging"
+	"github.com/spoconnor/Go-Client-Connector/metrics"
+	"github.com/spoconnor/Go-Client-Connector/registry"
+	"github.com/spoconnor/Go-Client-Connector/store"
+	"github.com/spoconnor/Go-Client-Connector/tracing"
 
 	"github.com/gobwas/ws"
-	"github.com/gobwas/ws/wsutil"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// Key handshake. The server sends KeyPlease followed by ":" and a nonce in a
+// binary frame. The client answers with a binary frame of two lines:
+// KeyPrefix followed by its key, and ProofPrefix followed by the
+// HandshakeProof for the nonce. Clients failing verification get Forbidden.
+// Session resumption adds an optional third line, see ResumePrefix.
 const (
-	Forbidden = "Forbidden"
-	KeyPlease = "ClientKeyPlease"
-	KeyPrefix = "ClientKey:"
+	Forbidden   = "Forbidden"
+	KeyPlease   = "ClientKeyPlease"
+	KeyPrefix   = "ClientKey:"
+	ProofPrefix = "ClientProof:"
 )
 
+// KeyProperty is the connection property binding a connection to a key,
+// usually set from an authentication token. The key handshake must claim the
+// bound key.
+const KeyProperty = "key"
+
+// DefaultCallTimeout bounds calls whose context carries no deadline.
+const DefaultCallTimeout = 30 * time.Second
+
+// DefaultPresenceHistory is how many presence events are kept per key.
+const DefaultPresenceHistory = 100
+
+// dispatchTimeout is how long client requests wait for a free worker before
+// they are rejected as busy.
+const dispatchTimeout = 10 * time.Millisecond
+
 // ConnectionsManager contains logic of connection interaction.
 type ConnectionsManager struct {
 	mu     sync.RWMutex
 	seq    uint
 	nextId int
 	us     []*Connection
-	ns     map[string]*Connection
-
-	pool *gopool.Pool
-	out  chan []byte
+	ns     map[string][]*Connection
+
+	pending   map[*Connection]struct{}            // connections before key handshake
+	sessions  map[string]*session                 // by resume token
+	suspended map[string][]*session               // by key, waiting to be resumed
+	topics    map[string]map[*Connection]struct{} // by topic filter
+	retained  map[string]*list.Element            // of recent, by topic
+	recent    *list.List                          // of *retainedTopic, least recently published first
+	closing   bool
+	done      chan struct{}      // closed on shutdown
+	ctx       context.Context    // canceled on shutdown, parent of the connection contexts
+	cancel    context.CancelFunc // of ctx
+
+	pool      *WorkerPool
+	listeners []func(*Event)
+	limits    atomic.Value // *RateLimits
+
+	outMu      sync.RWMutex // guards out against sends after close
+	out        chan frames
+	writerDone chan struct{}
+
+	// CallTimeout is applied to calls made with a context without deadline.
+	CallTimeout time.Duration
+
+	// Methods holds handlers of requests sent by clients.
+	Methods *MethodRegistry
+
+	// Secrets verifies keys claimed in the key handshake. When nil, every
+	// handshake is refused.
+	Secrets KeySecretStore
+
+	// DuplicateKeys decides what to do when a connected key connects again.
+	DuplicateKeys DuplicateKeyPolicy
+
+	// Store keeps the presence history and dead letters, by default in
+	// memory.
+	Store store.Store
+
+	// PresenceHistory is how many presence events are kept per key.
+	PresenceHistory int
+	// DeadLetterLimit is how many dead letters Store keeps.
+	DeadLetterLimit int
+
+	// Registry, when set, records registered connections for other
+	// services.
+	Registry registry.Registry
+
+	// Cluster, when set, connects this node to the other nodes, so calls
+	// reach keys connected anywhere in the cluster.
+	Cluster Cluster
+
+	// Offline, when set, keeps notifications for keys which are not
+	// connected. See QueueIfOffline.
+	Offline *OfflineQueue
+
+	// TopicHistory is how many of the latest messages of each topic are
+	// retained and sent to new subscribers. The latest is always retained.
+	TopicHistory int
+	// RetainedTopics bounds the topics messages are retained on. Beyond it
+	// the messages of the least recently published topic are dropped.
+	RetainedTopics int
+
+	// ResumeGrace is how long the session of a dropped connection can be
+	// resumed by a new connection. Zero disables resumption.
+	ResumeGrace time.Duration
 }
 
-// TODO - make parameter an interface type for testing
-func NewConnectionsManager(pool *gopool.Pool) *ConnectionsManager {
-	log.Printf("[NewConnectionsManager] Creating ConnectionsManager")
+// NewConnectionsManager creates a ConnectionsManager running its tasks on
+// pool, usually a *gopool.Pool.
+func NewConnectionsManager(pool Scheduler) *ConnectionsManager {
+	slog.Debug("[NewConnectionsManager] Creating ConnectionsManager")
+	ctx, cancel := context.WithCancel(context.Background())
 	connections := &ConnectionsManager{
-		pool:   pool,
-		ns:     make(map[string]*Connection),
-		out:    make(chan []byte, 1),
-		seq:    1,
-		nextId: 1,
+		ctx:        ctx,
+		cancel:     cancel,
+		pool:       NewWorkerPool(pool),
+		ns:         make(map[string][]*Connection),
+		pending:    make(map[*Connection]struct{}),
+		sessions:   make(map[string]*session),
+		suspended:  make(map[string][]*session),
+		topics:     make(map[string]map[*Connection]struct{}),
+		retained:   make(map[string]*list.Element),
+		recent:     list.New(),
+		done:       make(chan struct{}),
+		out:        make(chan frames, 1),
+		writerDone: make(chan struct{}),
+		seq:        1,
+		nextId:     1,
+
+		CallTimeout:     DefaultCallTimeout,
+		Methods:         NewMethodRegistry(),
+		Store:           store.NewMemoryStore(),
+		PresenceHistory: DefaultPresenceHistory,
+		DeadLetterLimit: store.DefaultDeadLetterLimit,
+		TopicHistory:    DefaultTopicHistory,
+		RetainedTopics:  DefaultRetainedTopics,
 	}
 
-	go connections.writer()
+	connections.registerTopicMethods()
+
+	go connections.writer(connections.out)
 
 	return connections
 }
 
-// Register registers new connection as a Connection.
-func (c *ConnectionsManager) Register(conn net.Conn) *Connection {
+// Register registers new connection as a Connection, which talks json-rpc in
+// the given wire format, and sends it the key request. properties may be nil.
+// onClose callbacks are registered before anything is written, so they run
+// even when the key request fails.
+func (c *ConnectionsManager) Register(conn net.Conn, format contracts.WireFormat, properties map[string]string, onClose ...func(*Connection)) *Connection {
+	if properties == nil {
+		properties = make(map[string]string)
+	}
+	ctx, cancel := context.WithCancel(c.ctx)
 	connection := &Connection{
+		ctx:                ctx,
+		cancel:             cancel,
 		connectionsManager: c,
 		conn:               conn,
-		awaitingReply:      make(map[int](chan *contracts.RpcResponse)),
+		format:             format,
+		remoteAddr:         conn.RemoteAddr().String(),
+		closed:             make(chan struct{}),
+		ended:              make(chan struct{}),
+		ConnectionId:       newConnectionId(),
+		DateTimeUtc:        time.Now().UTC(),
+		lastSeen:           time.Now().UTC(),
+		Properties:         properties,
+		awaitingReply:      make(map[int]awaiting),
+	}
+	for _, f := range onClose {
+		f := f
+		connection.OnClose(func() { f(connection) })
 	}
 
+	c.mu.Lock()
+	closing := c.closing
+	if !closing {
+		c.pending[connection] = struct{}{}
+	}
+	c.mu.Unlock()
+	if closing {
+		connection.logger().Info("[ConnectionsManager.Register] Shutting down, closing")
+		connection.writeClose(ws.StatusGoingAway, "Server shutting down")
+		connection.Close()
+		return connection
+	}
+
+	c.emit(ConnectedEvent, connection)
 	connection.SendKeyRequest()
 	//c.Broadcast("greet", websockets.Params{
 	//	"name": connection.name,
@@ -67,169 +212,515 @@ func (c *ConnectionsManager) Register(conn net.Conn) *Connection {
 	return connection
 }
 
-func (c *ConnectionsManager) ListConnections() string {
-	var res string
-	for k, _ := range c.ns {
-		res = res + k + ","
+// Keys returns the keys connected to this node, including keys whose
+// session waits to be resumed.
+func (c *ConnectionsManager) Keys() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	keys := make([]string, 0, len(c.ns)+len(c.suspended))
+	for key := range c.ns {
+		keys = append(keys, key)
+	}
+	for key := range c.suspended {
+		if _, ok := c.ns[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ConnectionList describes connected clients.
+type ConnectionList struct {
+	DuplicateKeyPolicy string
+	Connections        []ConnectionInfo
+}
+
+func (c *ConnectionsManager) ListConnections() *ConnectionList {
+	c.mu.RLock()
+	us := c.us
+	c.mu.RUnlock()
+
+	res := &ConnectionList{
+		DuplicateKeyPolicy: c.DuplicateKeys.String(),
+		Connections:        make([]ConnectionInfo, 0, len(us)),
+	}
+	for _, u := range us {
+		res.Connections = append(res.Connections, u.Info())
 	}
 	return res
 }
 
+// Counts returns the number of registered connections and of connections
+// which did not complete the key handshake yet.
+func (c *ConnectionsManager) Counts() (connected, pending int) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.us), len(c.pending)
+}
+
 func (c *ConnectionsManager) HaveConnectionKey(key string) bool {
 	c.mu.Lock()
-	_, has := c.ns[key]
+	has := len(c.ns[key]) > 0
 	c.mu.Unlock()
 	return has
 }
 
-func (c *ConnectionsManager) SetConnectionKey(connection *Connection, key string) {
+// isRegistered reports whether connection completed the key handshake.
+func (c *ConnectionsManager) isRegistered(connection *Connection) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.registered(connection)
+}
+
+// mutex must be held.
+func (c *ConnectionsManager) registered(connection *Connection) bool {
+	for _, u := range c.ns[connection.Key] {
+		if u == connection {
+			return true
+		}
+	}
+	return false
+}
+
+// connections returns connections with the given key.
+func (c *ConnectionsManager) connections(key string) []*Connection {
+	c.mu.RLock()
+	us := c.ns[key]
+	c.mu.RUnlock()
+	return us
+}
+
+// SetConnectionKey registers connection under key, applying the
+// DuplicateKeys policy when the key is already connected. Unless connections
+// are allowed to share keys, suspended sessions of key end and their held
+// notifications go to the new connection. It returns ErrDuplicateKey when
+// the connection is rejected.
+func (c *ConnectionsManager) SetConnectionKey(connection *Connection, key string) error {
+	var evicted, ended []*Connection
+	var queued []store.QueuedMessage
 	c.mu.Lock()
 	{
+		if c.closing {
+			c.mu.Unlock()
+			return ErrShuttingDown
+		}
+		if existing := c.ns[key]; len(existing) > 0 {
+			switch c.DuplicateKeys {
+			case RejectDuplicate:
+				c.mu.Unlock()
+				connection.logger().Info("[ConnectionsManager.SetConnectionKey] Rejecting duplicate connection", "claimed", key)
+				return ErrDuplicateKey
+			case EvictExisting:
+				evicted = existing
+				for _, u := range existing {
+					c.remove(u)
+					delete(c.sessions, u.token())
+				}
+			}
+		}
+		if c.DuplicateKeys != AllowMultiple {
+			ended, queued = c.endSuspended(key)
+		}
+
 		connection.id = c.seq
 		connection.Key = key
-		log.Printf("Adding connection %s", connection.Key)
+		connection.logger().Info("[ConnectionsManager.SetConnectionKey] Adding connection")
 		c.us = append(c.us, connection)
-		c.ns[connection.Key] = connection
+		c.ns[connection.Key] = append(c.ns[connection.Key], connection)
+		delete(c.pending, connection)
 
 		c.seq++
 	}
+	if c.Offline != nil {
+		queued = append(queued, c.Offline.take(key)...)
+	}
+	token := c.newSession(connection)
 	c.mu.Unlock()
 
-	/*
-		c.mu.Lock()
-		{
-			var prev string
-			if _, has := c.ns[key]; !has {
-				prev, connection.Key = connection.Key, key
-				log.Printf("Renamed connection %s to %s", prev, key)
-				delete(c.ns, prev)
-				c.ns[key] = connection
-			}
-		}
-		c.mu.Unlock()
-	*/
+	for _, u := range evicted {
+		u.logger().Info("[ConnectionsManager.SetConnectionKey] Evicting previous connection")
+		u.end(nil)
+		u.writeClose(ws.StatusPolicyViolation, "Replaced by a new connection")
+		u.Close()
+		c.disconnected(u)
+	}
+	for _, u := range ended {
+		u.logger().Info("[ConnectionsManager.SetConnectionKey] Ending suspended session")
+		u.end(nil)
+		c.disconnected(u)
+	}
+	c.connected(connection)
+	if token != "" {
+		connection.writeBinary([]byte(SessionPrefix + token))
+	}
+	connection.flush(queued)
+	return nil
 }
 
-// Remove removes connection from connectionsManager
+// Remove removes connection from connectionsManager. A resumable session is
+// suspended for ResumeGrace instead of ending.
 func (c *ConnectionsManager) Remove(connection *Connection) {
 	c.mu.Lock()
+	_, pending := c.pending[connection]
+	delete(c.pending, connection)
+	filters := connection.subscriptions()
 	removed := c.remove(connection)
+	closing := c.closing
+	suspended := removed && !closing && c.suspend(connection, filters)
+	if removed && !suspended {
+		delete(c.sessions, connection.token())
+	}
 	c.mu.Unlock()
 
+	if pending {
+		c.emit(DisconnectedEvent, connection)
+	}
 	if !removed {
 		return
 	}
+	if suspended {
+		connection.logger().Info("[ConnectionsManager.Remove] Suspending session", "grace", c.ResumeGrace)
+		return
+	}
+	connection.end(nil)
+	c.disconnected(connection)
+	if closing {
+		return
+	}
 
 	c.Broadcast("goodbye", contracts.RpcParams{
-		"name": connection.name,
+		"name": connection.Key,
 		"time": timestamp(),
 	})
 }
 
-// Broadcast sends message to all alive connections.
+// Broadcast sends message to all alive connections, on every node of the
+// cluster.
 func (c *ConnectionsManager) Broadcast(method string, params contracts.RpcParams) error {
-	var buf bytes.Buffer
-
-	w := wsutil.NewWriter(&buf, ws.StateServerSide, ws.OpText)
-	encoder := json.NewEncoder(w)
-
-	r := contracts.RpcRequest{ID: 0, Method: method, Params: params}
-	if err := encoder.Encode(r); err != nil {
+	if err := c.BroadcastLocal(method, params); err != nil {
 		return err
 	}
-	if err := w.Flush(); err != nil {
+	if c.Cluster != nil {
+		c.Cluster.Broadcast(method, params)
+	}
+	return nil
+}
+
+// BroadcastLocal sends message to all alive connections of this node.
+func (c *ConnectionsManager) BroadcastLocal(method string, params contracts.RpcParams) error {
+	f, err := requestFrames(&contracts.RpcRequest{Method: method, Params: params})
+	if err != nil {
 		return err
 	}
 
-	c.out <- buf.Bytes()
+	c.outMu.RLock()
+	defer c.outMu.RUnlock()
+	if c.out == nil {
+		return ErrShuttingDown
+	}
+	c.out <- f
 
 	return nil
 }
 
+// SendToClient sends a request to the client with the given key, forwarding
+// it to the owning node when the key is connected to another node of the
+// cluster. When waitForReply is set it blocks until the client replies or
+// ctx is done; if ctx has no deadline, CallTimeout is applied. A
+// *TimeoutError is returned when the deadline expires and ErrNotConnected
+// when the key is unknown.
 func (c *ConnectionsManager) SendToClient(
-	key string, method string,
+	ctx context.Context, key string, method string,
 	params contracts.RpcParams, waitForReply bool) (*contracts.RpcResponse, error) {
 
-	log.Printf("[SendToClient] Sending %s to %s", method, key)
-	var buf bytes.Buffer
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, "ConnectionsManager.SendToClient", trace.WithAttributes(
+		tracing.KeyAttribute.String(key),
+		tracing.MethodAttribute.String(method),
+		attribute.Bool("connector.wait_for_reply", waitForReply)))
+	var res *contracts.RpcResponse
+	var err error
+	if node, ok := c.remoteOwner(key); ok {
+		slog.Debug("[SendToClient] Forwarding", logging.KeyAttr, key, "method", method, "node", node)
+		span.SetAttributes(tracing.NodeAttribute.String(node))
+		res, err = c.Cluster.Forward(ctx, node, key, method, params, waitForReply)
+	} else {
+		res, err = c.SendToLocalClient(ctx, key, method, params, waitForReply)
+	}
+	if waitForReply {
+		metrics.CallDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	}
+	tracing.End(span, err)
+	return res, err
+}
+
+// SendToLocalClient is SendToClient for keys connected to this node only.
+func (c *ConnectionsManager) SendToLocalClient(
+	ctx context.Context, key string, method string,
+	params contracts.RpcParams, waitForReply bool) (*contracts.RpcResponse, error) {
 
-	w := wsutil.NewWriter(&buf, ws.StateServerSide, ws.OpText)
-	encoder := json.NewEncoder(w)
+	logging.Message(slog.Default(), "[SendToClient] Sending", params, logging.KeyAttr, key, "method", method)
 
-	r := contracts.RpcRequest{ID: c.nextId, Method: method, Params: params}
-	c.nextId++
-	if err := encoder.Encode(r); err != nil {
-		return nil, err
-	}
-	if err := w.Flush(); err != nil {
-		return nil, err
+	select {
+	case <-c.done:
+		return nil, ErrShuttingDown
+	default:
 	}
-	log.Printf("[SendToClient] Sending raw: %s", buf.String())
 
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if u, ok := c.ns[key]; ok {
-		u := u              // for closure
-		data := buf.Bytes() // for closure
-
-		if waitForReply {
-			err := u.writeRaw(data)
-			if err != nil {
-				log.Printf("[SendToClient] Error: %s", err)
+	us := c.connections(key)
+	if len(us) == 0 {
+		if !waitForReply {
+			if held, err := c.hold(key, method, params); held {
+				return nil, err
 			}
-			res, err := u.AwaitReply(r.ID)
-			return res, err
+		}
+		slog.Debug("[SendToClient] Not connected", logging.KeyAttr, key)
+		return nil, ErrNotConnected
+	}
 
-		} else {
+	id := c.nextRequestId()
+	params = tracing.WithContext(ctx, params)
+	f, err := requestFrames(&contracts.RpcRequest{ID: contracts.IntId(id), Method: method, Params: params})
+	if err != nil {
+		return nil, err
+	}
 
+	if !waitForReply {
+		for _, u := range us {
+			u := u              // for closure
+			data := f[u.format] // for closure
 			c.pool.Schedule(func() {
-				log.Printf("[SendToClient] Writing...")
-				err := u.writeRaw(data)
+				u.debug("[SendToClient] Writing", "method", method)
+				err := u.writeTraced(ctx, data)
 				if err != nil {
-					log.Printf("[SendToClient] Error: %s", err)
+					u.logger().Warn("[SendToClient] Error", "method", method, "err", err)
+					return
 				}
+				c.emitRpc(RpcSentEvent, u, method, id)
 			})
 		}
+		return nil, nil
+	}
+
+	if _, has := ctx.Deadline(); !has && c.CallTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.CallTimeout)
+		defer cancel()
+	}
 
+	var res *contracts.RpcResponse
+	if len(us) == 1 {
+		res, err = us[0].call(ctx, id, method, f[us[0].format])
 	} else {
-		log.Printf("[SendToClient] '%s' not found", key)
-		// TODO return error
+		res, err = c.callAny(ctx, us, id, method, f)
+	}
+	if err != nil {
+		if te, ok := err.(*TimeoutError); ok {
+			te.Method = method
+		}
+		slog.Info("[SendToClient] Error", logging.KeyAttr, key, "method", method, "err", err)
 	}
+	return res, err
+}
 
-	return nil, nil // TODO
+// callAny sends the request to every connection of a key and returns the
+// first reply. When none replies, the first error is returned.
+func (c *ConnectionsManager) callAny(ctx context.Context, us []*Connection, id int, method string, f frames) (*contracts.RpcResponse, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		res *contracts.RpcResponse
+		err error
+	}
+	results := make(chan result, len(us))
+	for _, u := range us {
+		go func(u *Connection) {
+			res, err := u.call(ctx, id, method, f[u.format])
+			results <- result{res, err}
+		}(u)
+	}
+
+	var firstErr error
+	for range us {
+		r := <-results
+		if r.err == nil {
+			return r.res, nil
+		}
+		if firstErr == nil {
+			firstErr = r.err
+		}
+	}
+	return nil, firstErr
 }
 
 //-----------------------------------------------------------
 
+// Shutdown stops accepting connections and calls, fails calls awaiting
+// replies, delivers queued broadcasts, then closes all connections with a
+// close frame and waits for pool tasks to finish, or ctx to be done.
+func (c *ConnectionsManager) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		return nil
+	}
+	slog.Info("[ConnectionsManager.Shutdown] Shutting down")
+	c.closing = true
+	close(c.done)
+	c.cancel()
+	us := make([]*Connection, 0, len(c.us)+len(c.pending))
+	us = append(us, c.us...)
+	for u := range c.pending {
+		us = append(us, u)
+	}
+	var suspended []*session
+	for key, ss := range c.suspended {
+		suspended = append(suspended, ss...)
+		c.endSuspended(key)
+	}
+	c.mu.Unlock()
+
+	for _, s := range suspended {
+		s.u.end(nil)
+		c.disconnected(s.u)
+		c.keepNotices(s.u.Key, s.notices)
+	}
+
+	// Drain broadcasts.
+	c.outMu.Lock()
+	close(c.out)
+	c.out = nil
+	c.outMu.Unlock()
+	select {
+	case <-c.writerDone:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if err := c.pool.Wait(ctx); err != nil {
+		return err
+	}
+
+	for _, u := range us {
+		u.writeClose(ws.StatusGoingAway, "Server shutting down")
+		u.Close()
+		c.Remove(u)
+	}
+
+	return c.pool.Wait(ctx)
+}
+
+// Pool returns the pool the manager runs its tasks on.
+func (c *ConnectionsManager) Pool() *WorkerPool {
+	return c.pool
+}
+
 // writer writes broadcast messages from out channel.
-func (c *ConnectionsManager) writer() {
-	for bts := range c.out {
+func (c *ConnectionsManager) writer(out <-chan frames) {
+	defer close(c.writerDone)
+	for f := range out {
 		c.mu.RLock()
 		us := c.us
 		c.mu.RUnlock()
 
+		start := time.Now()
+		if len(us) == 0 {
+			metrics.BroadcastFanout.Observe(0)
+		}
+		remaining := int64(len(us))
 		for _, u := range us {
-			u := u // For closure.
+			u := u             // For closure.
+			bts := f[u.format] // For closure.
 			c.pool.Schedule(func() {
-				log.Printf("[ConnectionsManager.writer] Writing broadcast...")
+				u.debug("[ConnectionsManager.writer] Writing broadcast")
 				u.writeRaw(bts)
+				if atomic.AddInt64(&remaining, -1) == 0 {
+					metrics.BroadcastFanout.Observe(time.Since(start).Seconds())
+				}
 			})
 		}
 	}
 }
 
+// connected records that connection completed the key handshake.
+func (c *ConnectionsManager) connected(connection *Connection) {
+	c.recordPresence(connection, store.Connected)
+	c.emit(KeyAssignedEvent, connection)
+	if c.Cluster != nil {
+		c.Cluster.Announce(connection.Key, true)
+	}
+	if c.Registry != nil {
+		c.Registry.Put(registry.Entry{
+			Key:          connection.Key,
+			ConnectionId: connection.ConnectionId,
+			Connected:    connection.DateTimeUtc,
+			Properties:   connection.Properties,
+		})
+	}
+}
+
+// disconnected records that a registered connection was removed.
+func (c *ConnectionsManager) disconnected(connection *Connection) {
+	c.recordPresence(connection, store.Disconnected)
+	c.emit(DisconnectedEvent, connection)
+	if c.Cluster != nil && !c.HaveConnectionKey(connection.Key) {
+		c.Cluster.Announce(connection.Key, false)
+	}
+	if c.Registry != nil {
+		c.Registry.Delete(connection.Key, connection.ConnectionId)
+	}
+}
+
+// recordPresence adds a presence event of connection to the history.
+func (c *ConnectionsManager) recordPresence(connection *Connection, event string) {
+	err := c.Store.AddPresence(store.PresenceEvent{
+		Key:          connection.Key,
+		ConnectionId: connection.ConnectionId,
+		RemoteAddr:   connection.remoteAddr,
+		Event:        event,
+		Time:         time.Now().UTC(),
+	}, c.PresenceHistory)
+	if err != nil {
+		connection.logger().Warn("[ConnectionsManager.recordPresence] Error", "err", err)
+	}
+}
+
+// nextRequestId returns a new id for server initiated requests.
+func (c *ConnectionsManager) nextRequestId() int {
+	c.mu.Lock()
+	id := c.nextId
+	c.nextId++
+	c.mu.Unlock()
+	return id
+}
+
 // mutex must be held.
 func (c *ConnectionsManager) remove(connection *Connection) bool {
-	if _, has := c.ns[connection.name]; !has {
+	list := c.ns[connection.Key]
+	j := -1
+	for k, u := range list {
+		if u == connection {
+			j = k
+		}
+	}
+	if j < 0 {
 		return false
 	}
+	c.unsubscribeAll(connection)
 
-	delete(c.ns, connection.name)
+	if len(list) == 1 {
+		delete(c.ns, connection.Key)
+	} else {
+		rest := make([]*Connection, 0, len(list)-1)
+		rest = append(rest, list[:j]...)
+		c.ns[connection.Key] = append(rest, list[j+1:]...)
+	}
 
 	i := sort.Search(len(c.us), func(i int) bool {
 		return c.us[i].id >= connection.id
 	})
-	if i >= len(c.us) {
+	if i >= len(c.us) || c.us[i] != connection {
 		panic("ConnectionsManager: inconsistent state")
 	}
 
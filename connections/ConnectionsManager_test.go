@@ -1,12 +1,25 @@
 package connections
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
-	"github.com/spoconnor/Go-Client-Connector/gopool"
+	"github.com/spoconnor/Go-Client-Connector/contracts"
+	"github.com/spoconnor/Go-Client-Connector/registry"
+	"github.com/spoconnor/Go-Client-Connector/store"
+	"github.com/spoconnor/Go-Common-Code/gopool"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
 )
 
 //--------------------------------------------------------
@@ -77,10 +90,10 @@ func TestSetKey(t *testing.T) {
 	conns := NewConnectionsManager(pool)
 
 	conn := &TestConn{}
-	connection := conns.Register(conn)
+	connection := conns.Register(conn, contracts.Legacy, nil)
 
-	if !conns.HaveConnectionKey(connection.Key) {
-		t.Errorf("Do not have key %v", connection.Key)
+	if conns.HaveConnectionKey("NewKey") {
+		t.Errorf("Have key %v before handshake", "NewKey")
 	}
 
 	conns.SetConnectionKey(connection, "NewKey")
@@ -90,10 +103,77 @@ func TestSetKey(t *testing.T) {
 	}
 }
 
+func TestRegisterFailedKeyRequest(t *testing.T) {
+	pool := gopool.NewPool(2, 1, 1)
+	conns := NewConnectionsManager(pool)
+
+	server, client := net.Pipe()
+	client.Close()
+	var closed *Connection
+	connection := conns.Register(server, contracts.Legacy, nil, func(u *Connection) {
+		closed = u
+		conns.Remove(u)
+	})
+	if closed != connection {
+		t.Fatal("OnClose callback did not run when the key request failed")
+	}
+	if _, pending := conns.Counts(); pending != 0 {
+		t.Errorf("%d pending connections after the key request failed", pending)
+	}
+}
+
+func TestSendToClientTimeout(t *testing.T) {
+	pool := gopool.NewPool(2, 1, 1)
+	conns := NewConnectionsManager(pool)
+
+	connection := conns.Register(&TestConn{}, contracts.Legacy, nil)
+	conns.SetConnectionKey(connection, "Silent")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := conns.SendToClient(ctx, "Silent", "Ping", nil, true)
+		if _, ok := err.(*TimeoutError); !ok {
+			t.Errorf("Expected *TimeoutError, got %v", err)
+		}
+	}()
+
+	// Registry must stay usable while the call is in flight.
+	if !conns.HaveConnectionKey("Silent") {
+		t.Errorf("Do not have key %v", "Silent")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("SendToClient did not return after deadline")
+	}
+
+	connection.mu.Lock()
+	pending := len(connection.awaitingReply)
+	connection.mu.Unlock()
+	if pending != 0 {
+		t.Errorf("Expected no awaiting replies, got %d", pending)
+	}
+}
+
+func TestSendToClientNotConnected(t *testing.T) {
+	pool := gopool.NewPool(2, 1, 1)
+	conns := NewConnectionsManager(pool)
+
+	_, err := conns.SendToClient(context.Background(), "Missing", "Ping", nil, true)
+	if err != ErrNotConnected {
+		t.Errorf("Expected ErrNotConnected, got %v", err)
+	}
+}
+
 //func NewConnectionsManager(pool *gopool.Pool) *ConnectionsManager {
 
 // Register registers new connection as a Connection.
-//func (c *ConnectionsManager) Register(conn net.Conn) *Connection {
+//func (c *ConnectionsManager) Register(conn net.Conn, format contracts.WireFormat, properties map[string]string) *Connection {
 
 //func (c *ConnectionsManager) SetConnectionKey(connection *Connection, key string) {
 
@@ -101,4 +181,884 @@ func TestSetKey(t *testing.T) {
 //func (c *ConnectionsManager) Remove(connection *Connection) {
 
 //func (c *ConnectionsManager) Broadcast(method string, params contracts.RpcParams) error {
-//func (c *ConnectionsManager) SendToClient(key string, method string, params contracts.RpcParams) error {
+//func (c *ConnectionsManager) SendToClient(ctx context.Context, key string, method string, params contracts.RpcParams, waitForReply bool) (*contracts.RpcResponse, error) {
+
+//--------------------------------------------------------
+
+// pipe registers the server end of an in-memory connection and returns it
+// together with the client end and the nonce of the key request.
+func pipe(t *testing.T, conns *ConnectionsManager, format contracts.WireFormat, properties map[string]string) (*Connection, net.Conn, string) {
+	server, client := net.Pipe()
+	registered := make(chan *Connection)
+	go func() {
+		registered <- conns.Register(server, format, properties)
+	}()
+	req, err := wsutil.ReadServerBinary(client)
+	if err != nil {
+		t.Fatalf("Reading key request: %v", err)
+	}
+	nonce := strings.TrimPrefix(string(req), KeyPlease+":")
+	return <-registered, client, nonce
+}
+
+// shakeHands answers the key request with the given key and proof and lets
+// the connection receive it.
+func shakeHands(connection *Connection, client net.Conn, key, proof string) error {
+	go wsutil.WriteClientBinary(client, []byte(KeyPrefix+key+"\n"+ProofPrefix+proof+"\n"))
+	return connection.Receive()
+}
+
+// roundTrip sends a text message from the client, lets the connection
+// receive it and returns the server reply.
+func roundTrip(t *testing.T, connection *Connection, client net.Conn, msg string) string {
+	go func() {
+		if err := wsutil.WriteClientText(client, []byte(msg)); err != nil {
+			t.Errorf("Writing %s: %v", msg, err)
+		}
+	}()
+	if err := connection.Receive(); err != nil {
+		t.Fatalf("Receive: %v", err)
+	}
+	reply, err := wsutil.ReadServerText(client)
+	if err != nil {
+		t.Fatalf("Reading reply: %v", err)
+	}
+	return string(reply)
+}
+
+func TestDispatchClientRequest(t *testing.T) {
+	pool := gopool.NewPool(2, 1, 1)
+	conns := NewConnectionsManager(pool)
+	conns.Methods.Register("greet", func(ctx context.Context, conn *Connection, params contracts.RpcParams) (interface{}, error) {
+		name, err := params.String("name")
+		if err != nil {
+			return nil, err
+		}
+		return "hello " + name, nil
+	})
+
+	conns.Secrets = StaticKeySecretStore{"Device": []byte("secret")}
+
+	connection, client, nonce := pipe(t, conns, contracts.JsonRpc2, nil)
+	defer client.Close()
+	if err := shakeHands(connection, client, "Device", HandshakeProof([]byte("secret"), nonce, "Device")); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+
+	tests := []struct {
+		req  string
+		want string
+	}{
+		{
+			`{"jsonrpc":"2.0","method":"greet","params":{"name":"bob"},"id":1}`,
+			`{"jsonrpc":"2.0","result":"hello bob","id":1}`,
+		},
+		{
+			`{"jsonrpc":"2.0","method":"greet","params":{},"id":"x"}`,
+			`{"jsonrpc":"2.0","error":{"code":-32602,"message":"missing string parameter 'name'"},"id":"x"}`,
+		},
+		{
+			`{"jsonrpc":"2.0","method":"rename","id":2}`,
+			`{"jsonrpc":"2.0","error":{"code":-32601,"message":"method 'rename' not found"},"id":2}`,
+		},
+		{
+			`[{"jsonrpc":"2.0","method":"greet","params":{"name":"al"}},{"jsonrpc":"2.0","method":"greet","params":{"name":"jo"},"id":3}]`,
+			`[{"jsonrpc":"2.0","result":"hello jo","id":3}]`,
+		},
+	}
+	for _, test := range tests {
+		if got := roundTrip(t, connection, client, test.req); got != test.want {
+			t.Errorf("%s replied %s; want %s", test.req, got, test.want)
+		}
+	}
+}
+
+func TestHandlerCanceledOnClose(t *testing.T) {
+	pool := gopool.NewPool(2, 1, 1)
+	conns := NewConnectionsManager(pool)
+	started, canceled := make(chan struct{}), make(chan struct{})
+	conns.Methods.Register("wait", func(ctx context.Context, conn *Connection, params contracts.RpcParams) (interface{}, error) {
+		close(started)
+		<-ctx.Done()
+		close(canceled)
+		return nil, ctx.Err()
+	})
+	conns.Secrets = StaticKeySecretStore{"Device": []byte("secret")}
+
+	connection, client, nonce := pipe(t, conns, contracts.JsonRpc2, nil)
+	defer client.Close()
+	if err := shakeHands(connection, client, "Device", HandshakeProof([]byte("secret"), nonce, "Device")); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	go wsutil.WriteClientText(client, []byte(`{"jsonrpc":"2.0","method":"wait","id":1}`))
+	if err := connection.Receive(); err != nil {
+		t.Fatalf("Receive: %v", err)
+	}
+	<-started
+	connection.Close()
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Error("Handler was not canceled when the connection closed")
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	pool := gopool.NewPool(2, 1, 1)
+	conns := NewConnectionsManager(pool)
+	conns.Secrets = StaticKeySecretStore{"Device": []byte("secret")}
+
+	connection, client, nonce := pipe(t, conns, contracts.Legacy, nil)
+	defer client.Close()
+	if err := shakeHands(connection, client, "Device", HandshakeProof([]byte("secret"), nonce, "Device")); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	if !conns.HaveConnectionKey("Device") {
+		t.Errorf("Do not have key %v", "Device")
+	}
+}
+
+func TestHandshakeForbidden(t *testing.T) {
+	pool := gopool.NewPool(2, 1, 1)
+	conns := NewConnectionsManager(pool)
+	conns.Secrets = StaticKeySecretStore{"Device": []byte("secret"), "Other": []byte("other")}
+
+	tests := []struct {
+		key        string
+		proof      func(nonce string) string
+		properties map[string]string
+	}{
+		{"Device", func(nonce string) string { return HandshakeProof([]byte("guess"), nonce, "Device") }, nil},
+		{"Device", func(nonce string) string { return HandshakeProof([]byte("secret"), "replayed", "Device") }, nil},
+		{"Unknown", func(nonce string) string { return HandshakeProof([]byte("secret"), nonce, "Unknown") }, nil},
+		{"Other", func(nonce string) string { return HandshakeProof([]byte("other"), nonce, "Other") }, map[string]string{KeyProperty: "Device"}},
+	}
+	for _, test := range tests {
+		connection, client, nonce := pipe(t, conns, contracts.Legacy, test.properties)
+		refused := make(chan string)
+		go func() {
+			msg, _ := wsutil.ReadServerBinary(client)
+			io.Copy(ioutil.Discard, client) // Close frame.
+			refused <- string(msg)
+		}()
+		if err := shakeHands(connection, client, test.key, test.proof(nonce)); err == nil {
+			t.Errorf("Handshake for %s succeeded", test.key)
+		}
+		if msg := <-refused; msg != Forbidden {
+			t.Errorf("Expected %s, got %s", Forbidden, msg)
+		}
+		if conns.HaveConnectionKey(test.key) {
+			t.Errorf("Have unverified key %v", test.key)
+		}
+		client.Close()
+	}
+}
+
+func TestDuplicateKeyPolicy(t *testing.T) {
+	tests := []struct {
+		policy      DuplicateKeyPolicy
+		err         error
+		first       bool
+		second      bool
+		connections int
+	}{
+		{EvictExisting, nil, false, true, 1},
+		{RejectDuplicate, ErrDuplicateKey, true, false, 1},
+		{AllowMultiple, nil, true, true, 2},
+	}
+	for _, test := range tests {
+		pool := gopool.NewPool(2, 1, 1)
+		conns := NewConnectionsManager(pool)
+		conns.DuplicateKeys = test.policy
+
+		first := conns.Register(&TestConn{}, contracts.Legacy, nil)
+		second := conns.Register(&TestConn{}, contracts.Legacy, nil)
+		if err := conns.SetConnectionKey(first, "Key"); err != nil {
+			t.Fatalf("%s: first connection: %v", test.policy, err)
+		}
+		if err := conns.SetConnectionKey(second, "Key"); err != test.err {
+			t.Errorf("%s: second connection error %v; want %v", test.policy, err, test.err)
+		}
+
+		if got := conns.isRegistered(first); got != test.first {
+			t.Errorf("%s: first registered %v; want %v", test.policy, got, test.first)
+		}
+		if got := conns.isRegistered(second); got != test.second {
+			t.Errorf("%s: second registered %v; want %v", test.policy, got, test.second)
+		}
+		list := conns.ListConnections()
+		if len(list.Connections) != test.connections {
+			t.Errorf("%s: %d connections; want %d", test.policy, len(list.Connections), test.connections)
+		}
+		if list.DuplicateKeyPolicy != test.policy.String() {
+			t.Errorf("%s: listed policy %s", test.policy, list.DuplicateKeyPolicy)
+		}
+
+		conns.Remove(first)
+		conns.Remove(second)
+		if conns.HaveConnectionKey("Key") {
+			t.Errorf("%s: have key after removing all connections", test.policy)
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	pool := gopool.NewPool(2, 1, 1)
+	conns := NewConnectionsManager(pool)
+
+	connection := conns.Register(&TestConn{}, contracts.Legacy, nil)
+	conns.SetConnectionKey(connection, "Silent")
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := conns.SendToClient(context.Background(), "Silent", "Ping", nil, true)
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := conns.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+
+	select {
+	case err := <-done:
+		if err != ErrShuttingDown {
+			t.Errorf("Expected ErrShuttingDown, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("SendToClient did not return after shutdown")
+	}
+	if conns.HaveConnectionKey("Silent") {
+		t.Errorf("Still have key %v after shutdown", "Silent")
+	}
+	if err := conns.Broadcast("Ping", nil); err != ErrShuttingDown {
+		t.Errorf("Expected ErrShuttingDown from Broadcast, got %v", err)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	pool := gopool.NewPool(2, 1, 1)
+	conns := NewConnectionsManager(pool)
+	conns.Secrets = StaticKeySecretStore{"Device": []byte("secret")}
+
+	connection, client, nonce := pipe(t, conns, contracts.Legacy, nil)
+	defer client.Close()
+	if err := shakeHands(connection, client, "Device", HandshakeProof([]byte("secret"), nonce, "Device")); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+
+	conns.heartbeat(time.Minute)
+	ping, err := ws.ReadFrame(client)
+	if err != nil {
+		t.Fatalf("Reading ping: %v", err)
+	}
+	if ping.Header.OpCode != ws.OpPing {
+		t.Fatalf("Expected ping, got opcode %d", ping.Header.OpCode)
+	}
+	go wsutil.WriteClientMessage(client, ws.OpPong, ping.Payload)
+	if err := connection.Receive(); err != nil {
+		t.Fatalf("Receive: %v", err)
+	}
+	if rtt := connection.Info().RoundTripMs; rtt <= 0 {
+		t.Errorf("Expected round trip time, got %v", rtt)
+	}
+
+	connection.mu.Lock()
+	connection.lastSeen = connection.lastSeen.Add(-2 * time.Minute)
+	connection.mu.Unlock()
+	conns.heartbeat(time.Minute)
+	if conns.HaveConnectionKey("Device") {
+		t.Errorf("Silent connection %v was not evicted", "Device")
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	var b tokenBucket
+	now := time.Now()
+	if !b.has(3, 2, 4, now) {
+		t.Fatal("full bucket of 4 refused 3 tokens")
+	}
+	b.take(3)
+	if b.has(2, 2, 4, now) {
+		t.Fatal("bucket of 1 allowed 2 tokens")
+	}
+	if !b.has(2, 2, 4, now.Add(500*time.Millisecond)) {
+		t.Error("refilled bucket refused 2 tokens")
+	}
+	if !b.has(4, 2, 4, now.Add(time.Hour)) || b.has(5, 2, 4, now.Add(time.Hour)) {
+		t.Error("bucket was refilled beyond its burst")
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	pool := gopool.NewPool(2, 1, 1)
+	conns := NewConnectionsManager(pool)
+	conns.Methods.Register("ping", func(ctx context.Context, conn *Connection, params contracts.RpcParams) (interface{}, error) {
+		return "pong", nil
+	})
+	conns.Secrets = StaticKeySecretStore{"Device": []byte("secret")}
+
+	connection, client, nonce := pipe(t, conns, contracts.JsonRpc2, nil)
+	defer client.Close()
+	if err := shakeHands(connection, client, "Device", HandshakeProof([]byte("secret"), nonce, "Device")); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+
+	conns.SetRateLimits(RateLimits{Messages: 1, Action: ReplyError})
+	req := `{"jsonrpc":"2.0","method":"ping","id":1}`
+	if got := roundTrip(t, connection, client, req); got != `{"jsonrpc":"2.0","result":"pong","id":1}` {
+		t.Errorf("First message replied %s", got)
+	}
+	// The error is written by Receive itself, not by the pool.
+	go wsutil.WriteClientText(client, []byte(req))
+	go connection.Receive()
+	reply, err := wsutil.ReadServerText(client)
+	if err != nil {
+		t.Fatalf("Reading reply: %v", err)
+	}
+	if got := string(reply); got != `{"jsonrpc":"2.0","error":{"code":-32000,"message":"rate limit exceeded"},"id":null}` {
+		t.Errorf("Limited message replied %s", got)
+	}
+
+	// Dropped frames, control frames too, are discarded without breaking
+	// the stream.
+	conns.SetRateLimits(RateLimits{Bytes: 10, Action: DropMessage})
+	go func() {
+		wsutil.WriteClientText(client, []byte(req))
+		wsutil.WriteClientMessage(client, ws.OpPing, []byte("a long ping payload"))
+	}()
+	for i := 0; i < 2; i++ {
+		if err := connection.Receive(); err != nil {
+			t.Fatalf("Receive: %v", err)
+		}
+	}
+	if n := connection.Info().RateLimited; n != 3 {
+		t.Errorf("RateLimited = %d; want 3", n)
+	}
+	conns.SetRateLimits(RateLimits{})
+	if got := roundTrip(t, connection, client, req); got != `{"jsonrpc":"2.0","result":"pong","id":1}` {
+		t.Errorf("Message after dropped ones replied %s", got)
+	}
+
+	// A message exceeding one limit takes nothing from the other.
+	conns.SetRateLimits(RateLimits{Messages: 1, Bytes: 10, Action: DropMessage})
+	later := time.Now().Add(time.Hour)
+	if _, allowed := connection.allow(11, later); allowed {
+		t.Error("Message exceeding the byte burst was allowed")
+	}
+	if _, allowed := connection.allow(10, later); !allowed {
+		t.Error("Message exceeding the byte limit took a message token")
+	}
+
+	conns.SetRateLimits(RateLimits{Bytes: 10, Action: CloseConnection})
+	go wsutil.WriteClientText(client, []byte(req))
+	received := make(chan error, 1)
+	go func() { received <- connection.Receive() }()
+	frame, err := ws.ReadFrame(client)
+	if err != nil {
+		t.Fatalf("Reading close frame: %v", err)
+	}
+	if code, _ := ws.ParseCloseFrameData(frame.Payload); frame.Header.OpCode != ws.OpClose || code != ws.StatusPolicyViolation {
+		t.Errorf("Expected policy violation close, got opcode %d code %d", frame.Header.OpCode, code)
+	}
+	if err := <-received; err != ErrRateLimited {
+		t.Errorf("Receive returned %v", err)
+	}
+	select {
+	case <-connection.closed:
+	default:
+		t.Error("Limited connection was not closed")
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	conns := NewConnectionsManager(gopool.NewPool(2, 1, 1))
+	conns.Secrets = StaticKeySecretStore{"Device": []byte("secret")}
+	connection, client, nonce := pipe(t, conns, contracts.JsonRpc2, nil)
+	defer client.Close()
+	if err := shakeHands(connection, client, "Device", HandshakeProof([]byte("secret"), nonce, "Device")); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+
+	conns.SetRateLimits(RateLimits{MaxMessageSize: 10})
+	go wsutil.WriteClientText(client, []byte(`{"jsonrpc":"2.0","method":"ping","id":1}`))
+	received := make(chan error, 1)
+	go func() { received <- connection.Receive() }()
+	frame, err := ws.ReadFrame(client)
+	if err != nil {
+		t.Fatalf("Reading close frame: %v", err)
+	}
+	if code, _ := ws.ParseCloseFrameData(frame.Payload); frame.Header.OpCode != ws.OpClose || code != ws.StatusMessageTooBig {
+		t.Errorf("Expected message too big close, got opcode %d code %d", frame.Header.OpCode, code)
+	}
+	if err := <-received; err != ErrMessageTooBig {
+		t.Errorf("Receive returned %v", err)
+	}
+}
+
+func TestTopics(t *testing.T) {
+	pool := gopool.NewPool(2, 1, 1)
+	conns := NewConnectionsManager(pool)
+	conns.Secrets = StaticKeySecretStore{"Device": []byte("secret")}
+
+	connection, client, nonce := pipe(t, conns, contracts.JsonRpc2, nil)
+	defer client.Close()
+	if err := shakeHands(connection, client, "Device", HandshakeProof([]byte("secret"), nonce, "Device")); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+
+	reply := roundTrip(t, connection, client, `{"jsonrpc":"2.0","method":"subscribe","params":{"topic":"news"},"id":1}`)
+	if want := `{"jsonrpc":"2.0","result":true,"id":1}`; reply != want {
+		t.Errorf("subscribe replied %s; want %s", reply, want)
+	}
+	if subscribers := conns.Subscribers("news"); len(subscribers) != 1 || subscribers[0].Key != "Device" {
+		t.Errorf("Expected Device subscribed, got %v", subscribers)
+	}
+
+	n, err := conns.Publish("news", "headline", contracts.RpcParams{"text": "hi"})
+	if err != nil || n != 1 {
+		t.Fatalf("Publish returned %d, %v", n, err)
+	}
+	msg, err := wsutil.ReadServerText(client)
+	if err != nil {
+		t.Fatalf("Reading publication: %v", err)
+	}
+	if want := `{"jsonrpc":"2.0","method":"headline","params":{"text":"hi"}}`; string(msg) != want {
+		t.Errorf("Received %s; want %s", msg, want)
+	}
+
+	if n, _ := conns.Publish("sports", "score", nil); n != 0 {
+		t.Errorf("Published to %d subscribers of sports", n)
+	}
+
+	conns.Remove(connection)
+	if subscribers := conns.Subscribers("news"); len(subscribers) != 0 {
+		t.Errorf("Expected no subscribers after Remove, got %v", subscribers)
+	}
+}
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"news", "news", true},
+		{"news", "news/sport", false},
+		{"news/+", "news/sport", true},
+		{"news/+", "news", false},
+		{"news/+/today", "news/sport/today", true},
+		{"news/#", "news", true},
+		{"news/#", "news/sport/today", true},
+		{"#", "news/sport", true},
+		{"+/+", "news/sport", true},
+		{"+", "news/sport", false},
+	}
+	for _, test := range tests {
+		if got := matchTopic(test.filter, test.topic); got != test.want {
+			t.Errorf("matchTopic(%s, %s) = %v; want %v", test.filter, test.topic, got, test.want)
+		}
+	}
+	for _, filter := range []string{"", "news/#/today", "news/sp+", "news#"} {
+		if validTopicFilter(filter) {
+			t.Errorf("Filter '%s' accepted", filter)
+		}
+	}
+}
+
+func TestRetainedMessages(t *testing.T) {
+	pool := gopool.NewPool(2, 1, 1)
+	conns := NewConnectionsManager(pool)
+	conns.TopicHistory = 2
+	conns.Secrets = StaticKeySecretStore{"Device": []byte("secret")}
+
+	for i, text := range []string{"one", "two", "three"} {
+		conns.Publish("news/sport", "headline", contracts.RpcParams{"text": text})
+		conns.Publish("weather", "forecast", contracts.RpcParams{"n": i})
+	}
+
+	connection, client, nonce := pipe(t, conns, contracts.JsonRpc2, nil)
+	defer client.Close()
+	if err := shakeHands(connection, client, "Device", HandshakeProof([]byte("secret"), nonce, "Device")); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	if err := conns.Subscribe(connection, "news/#"); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	for _, want := range []string{
+		`{"jsonrpc":"2.0","method":"headline","params":{"text":"two"}}`,
+		`{"jsonrpc":"2.0","method":"headline","params":{"text":"three"}}`,
+	} {
+		msg, err := wsutil.ReadServerText(client)
+		if err != nil {
+			t.Fatalf("Reading retained message: %v", err)
+		}
+		if string(msg) != want {
+			t.Errorf("Received %s; want %s", msg, want)
+		}
+	}
+}
+
+func TestRetainedTopicsBound(t *testing.T) {
+	conns := NewConnectionsManager(gopool.NewPool(2, 1, 1))
+	conns.RetainedTopics = 2
+	conns.Publish("a", "m", nil)
+	conns.Publish("b", "m", nil)
+	conns.Publish("a", "m", nil)
+	conns.Publish("c", "m", nil)
+
+	conns.mu.RLock()
+	defer conns.mu.RUnlock()
+	if len(conns.retained) != 2 || conns.recent.Len() != 2 {
+		t.Fatalf("Retained %d topics; want 2", len(conns.retained))
+	}
+	if _, ok := conns.retained["b"]; ok {
+		t.Error("Least recently published topic was kept")
+	}
+	if n := len(conns.retainedFor("#")); n != 2 {
+		t.Errorf("Retained %d messages; want 2", n)
+	}
+}
+
+func TestSendToKeys(t *testing.T) {
+	pool := gopool.NewPool(4, 1, 1)
+	conns := NewConnectionsManager(pool)
+	conns.Secrets = StaticKeySecretStore{"Replying": []byte("secret"), "Silent": []byte("secret")}
+
+	replying, replyingClient, nonce := pipe(t, conns, contracts.JsonRpc2, nil)
+	defer replyingClient.Close()
+	if err := shakeHands(replying, replyingClient, "Replying", HandshakeProof([]byte("secret"), nonce, "Replying")); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	silent, silentClient, nonce := pipe(t, conns, contracts.JsonRpc2, nil)
+	defer silentClient.Close()
+	if err := shakeHands(silent, silentClient, "Silent", HandshakeProof([]byte("secret"), nonce, "Silent")); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+
+	go func() {
+		req, err := wsutil.ReadServerText(replyingClient)
+		if err != nil {
+			t.Errorf("Reading request: %v", err)
+			return
+		}
+		var m struct{ ID int }
+		json.Unmarshal(req, &m)
+		go replying.Receive()
+		wsutil.WriteClientText(replyingClient, []byte(fmt.Sprintf(`{"jsonrpc":"2.0","result":"pong","id":%d}`, m.ID)))
+	}()
+	go wsutil.ReadServerText(silentClient)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	res, err := conns.SendToKeys(ctx, []string{"Replying", "Silent", "Gone", "Replying"}, "Ping", nil, true)
+	if err != nil {
+		t.Fatalf("SendToKeys failed: %v", err)
+	}
+	want := map[string]Outcome{"Replying": Replied, "Silent": TimedOut, "Gone": NotConnected}
+	if len(res) != len(want) {
+		t.Errorf("Expected %d results, got %v", len(want), res)
+	}
+	for key, outcome := range want {
+		if r := res[key]; r == nil || r.Outcome != outcome {
+			t.Errorf("%s: got %+v; want %s", key, r, outcome)
+		}
+	}
+	if r := res["Replying"]; r != nil && r.Result != "pong" {
+		t.Errorf("Replying: got result %v", r.Result)
+	}
+}
+
+func TestGather(t *testing.T) {
+	pool := gopool.NewPool(4, 1, 1)
+	conns := NewConnectionsManager(pool)
+	conns.Secrets = StaticKeySecretStore{"One": []byte("secret"), "Two": []byte("secret"), "Other": []byte("secret")}
+
+	for key, tenant := range map[string]string{"One": "acme", "Two": "acme", "Other": "other"} {
+		connection, client, nonce := pipe(t, conns, contracts.JsonRpc2, map[string]string{"tenant": tenant})
+		defer client.Close()
+		if err := shakeHands(connection, client, key, HandshakeProof([]byte("secret"), nonce, key)); err != nil {
+			t.Fatalf("Handshake failed: %v", err)
+		}
+		if tenant != "acme" {
+			continue
+		}
+		go func(connection *Connection, client net.Conn, key string) {
+			req, err := wsutil.ReadServerText(client)
+			if err != nil {
+				t.Errorf("Reading request: %v", err)
+				return
+			}
+			var m struct{ ID int }
+			json.Unmarshal(req, &m)
+			go connection.Receive()
+			wsutil.WriteClientText(client, []byte(fmt.Sprintf(`{"jsonrpc":"2.0","result":"%s-1.0","id":%d}`, key, m.ID)))
+		}(connection, client, key)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	results, err := conns.Gather(ctx, "Version", nil, map[string]string{"tenant": "acme"}, 0)
+	if err != nil {
+		t.Fatalf("Gather failed: %v", err)
+	}
+	got := map[string]interface{}{}
+	for r := range results {
+		if r.Outcome != Replied {
+			t.Errorf("%s: got outcome %s", r.Key, r.Outcome)
+		}
+		got[r.Key] = r.Result
+	}
+	if len(got) != 2 || got["One"] != "One-1.0" || got["Two"] != "Two-1.0" {
+		t.Errorf("Gathered %v", got)
+	}
+}
+
+func TestOfflineQueue(t *testing.T) {
+	pool := gopool.NewPool(2, 1, 1)
+	conns := NewConnectionsManager(pool)
+	st := store.NewMemoryStore()
+	conns.Offline = NewOfflineQueue(st, time.Minute, 2)
+	conns.Secrets = StaticKeySecretStore{"Device": []byte("secret")}
+
+	for _, text := range []string{"one", "two"} {
+		if queued, err := conns.QueueIfOffline("Device", "note", contracts.RpcParams{"text": text}); !queued || err != nil {
+			t.Fatalf("QueueIfOffline returned %v, %v", queued, err)
+		}
+	}
+	if _, err := conns.QueueIfOffline("Device", "note", nil); err != ErrQueueFull {
+		t.Errorf("Expected ErrQueueFull, got %v", err)
+	}
+	st.SetQueued("Expired", []store.QueuedMessage{{Method: "note", Expires: time.Now().Add(-time.Second)}})
+	if n, err := conns.Offline.Purge("Expired"); n != 0 || err != nil {
+		t.Errorf("Purged %d expired messages, %v", n, err)
+	}
+	if dead, _ := st.DeadLetters(0); len(dead) != 1 || dead[0].Key != "Expired" {
+		t.Errorf("Expected expired message in dead letters, got %v", dead)
+	}
+
+	connection, client, nonce := pipe(t, conns, contracts.JsonRpc2, nil)
+	defer client.Close()
+	go func() {
+		if err := shakeHands(connection, client, "Device", HandshakeProof([]byte("secret"), nonce, "Device")); err != nil {
+			t.Errorf("Handshake failed: %v", err)
+		}
+	}()
+	for _, text := range []string{"one", "two"} {
+		msg, err := wsutil.ReadServerText(client)
+		if err != nil {
+			t.Fatalf("Reading queued message: %v", err)
+		}
+		if want := `{"jsonrpc":"2.0","method":"note","params":{"text":"` + text + `"}}`; string(msg) != want {
+			t.Errorf("Received %s; want %s", msg, want)
+		}
+	}
+	if queued, _ := conns.Offline.Peek("Device"); len(queued) != 0 {
+		t.Errorf("Queue not flushed: %v", queued)
+	}
+	if queued, err := conns.QueueIfOffline("Device", "note", nil); queued || err != nil {
+		t.Errorf("Connected key: QueueIfOffline returned %v, %v", queued, err)
+	}
+}
+
+type testRegistry struct {
+	mu      sync.Mutex
+	entries map[string]registry.Entry
+}
+
+func (r *testRegistry) Put(e registry.Entry) {
+	r.mu.Lock()
+	r.entries[e.ConnectionId] = e
+	r.mu.Unlock()
+}
+
+func (r *testRegistry) Delete(key, connectionId string) {
+	r.mu.Lock()
+	delete(r.entries, connectionId)
+	r.mu.Unlock()
+}
+
+func TestRegistry(t *testing.T) {
+	pool := gopool.NewPool(2, 1, 1)
+	conns := NewConnectionsManager(pool)
+	reg := &testRegistry{entries: make(map[string]registry.Entry)}
+	conns.Registry = reg
+	conns.Secrets = StaticKeySecretStore{"Device": []byte("secret")}
+
+	connection, client, nonce := pipe(t, conns, contracts.Legacy, map[string]string{"tenant": "acme"})
+	defer client.Close()
+	if err := shakeHands(connection, client, "Device", HandshakeProof([]byte("secret"), nonce, "Device")); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	if e, ok := reg.entries[connection.ConnectionId]; !ok || e.Key != "Device" || e.Properties["tenant"] != "acme" {
+		t.Errorf("Registry has %+v", reg.entries)
+	}
+
+	conns.Remove(connection)
+	if len(reg.entries) != 0 {
+		t.Errorf("Registry still has %+v", reg.entries)
+	}
+}
+
+func TestResumeSession(t *testing.T) {
+	pool := gopool.NewPool(4, 1, 1)
+	conns := NewConnectionsManager(pool)
+	conns.Secrets = StaticKeySecretStore{"Device": []byte("secret")}
+	conns.ResumeGrace = time.Minute
+
+	first, client, nonce := pipe(t, conns, contracts.JsonRpc2, map[string]string{"tenant": "acme"})
+	defer client.Close()
+	go func() {
+		if err := shakeHands(first, client, "Device", HandshakeProof([]byte("secret"), nonce, "Device")); err != nil {
+			t.Errorf("Handshake failed: %v", err)
+		}
+	}()
+	msg, err := wsutil.ReadServerBinary(client)
+	if err != nil || !strings.HasPrefix(string(msg), SessionPrefix) {
+		t.Fatalf("Expected session token, got %s, %v", msg, err)
+	}
+	token := strings.TrimPrefix(string(msg), SessionPrefix)
+
+	// A call in flight when the connection drops.
+	replied := make(chan *contracts.RpcResponse)
+	go func() {
+		res, err := conns.SendToClient(context.Background(), "Device", "Ping", nil, true)
+		if err != nil {
+			t.Errorf("Call failed: %v", err)
+		}
+		replied <- res
+	}()
+	var req struct{ ID int }
+	if msg, err := wsutil.ReadServerText(client); err != nil || json.Unmarshal(msg, &req) != nil {
+		t.Fatalf("Reading request: %s, %v", msg, err)
+	}
+
+	first.Close()
+	conns.Remove(first)
+	if conns.HaveConnectionKey("Device") || len(conns.Keys()) != 1 {
+		t.Errorf("Suspended key connected: %v, keys %v", conns.HaveConnectionKey("Device"), conns.Keys())
+	}
+	if _, err := conns.SendToClient(context.Background(), "Device", "note", nil, false); err != nil {
+		t.Errorf("Notification for suspended key failed: %v", err)
+	}
+
+	second, client2, nonce := pipe(t, conns, contracts.JsonRpc2, nil)
+	defer client2.Close()
+	go wsutil.WriteClientBinary(client2, []byte(KeyPrefix+"Device\n"+
+		ProofPrefix+HandshakeProof([]byte("secret"), nonce, "Device")+"\n"+ResumePrefix+token+"\n"))
+	go func() {
+		if err := second.Receive(); err != nil {
+			t.Errorf("Resume failed: %v", err)
+		}
+	}()
+	if msg, err := wsutil.ReadServerBinary(client2); err != nil || !strings.HasPrefix(string(msg), ResumedPrefix) {
+		t.Fatalf("Expected resumed session, got %s, %v", msg, err)
+	}
+	if msg, err := wsutil.ReadServerText(client2); err != nil || string(msg) != `{"jsonrpc":"2.0","method":"note"}` {
+		t.Errorf("Expected held notification, got %s, %v", msg, err)
+	}
+	go wsutil.WriteClientText(client2, []byte(fmt.Sprintf(`{"jsonrpc":"2.0","result":"pong","id":%d}`, req.ID)))
+	if err := second.Receive(); err != nil {
+		t.Fatalf("Receive: %v", err)
+	}
+	if res := <-replied; res == nil || res.Result != "pong" {
+		t.Errorf("Call got %v", res)
+	}
+	if second.ConnectionId != first.ConnectionId || second.Properties["tenant"] != "acme" {
+		t.Errorf("Session not taken over: %s %v", second.ConnectionId, second.Properties)
+	}
+	if events, _ := conns.Store.Presence("Device"); len(events) != 1 {
+		t.Errorf("Expected a single presence event, got %v", events)
+	}
+
+	// Not resumed in time.
+	conns.ResumeGrace = 10 * time.Millisecond
+	second.Close()
+	conns.Remove(second)
+	time.Sleep(100 * time.Millisecond)
+	if events, _ := conns.Store.Presence("Device"); len(events) != 2 || events[1].Event != store.Disconnected {
+		t.Errorf("Expected disconnect after grace, got %v", events)
+	}
+	if keys := conns.Keys(); len(keys) != 0 {
+		t.Errorf("Expired session still has keys %v", keys)
+	}
+}
+
+// TestQueueDuringResumeGrace covers jsonRpc with ?queue=true while the
+// session of the key waits to be resumed.
+func TestQueueDuringResumeGrace(t *testing.T) {
+	for _, offline := range []bool{true, false} {
+		pool := gopool.NewPool(4, 1, 1)
+		conns := NewConnectionsManager(pool)
+		conns.Secrets = StaticKeySecretStore{"Device": []byte("secret")}
+		conns.ResumeGrace = time.Minute
+		if offline {
+			conns.Offline = NewOfflineQueue(store.NewMemoryStore(), time.Minute, 10)
+		}
+
+		first, client, nonce := pipe(t, conns, contracts.JsonRpc2, nil)
+		go func() {
+			if err := shakeHands(first, client, "Device", HandshakeProof([]byte("secret"), nonce, "Device")); err != nil {
+				t.Errorf("Handshake failed: %v", err)
+			}
+		}()
+		msg, err := wsutil.ReadServerBinary(client)
+		if err != nil || !strings.HasPrefix(string(msg), SessionPrefix) {
+			t.Fatalf("Expected session token, got %s, %v", msg, err)
+		}
+		token := strings.TrimPrefix(string(msg), SessionPrefix)
+		first.Close()
+		conns.Remove(first)
+		client.Close()
+
+		if queued, err := conns.QueueIfOffline("Device", "note", nil); !queued || err != nil {
+			t.Fatalf("offline queue %v: QueueIfOffline returned %v, %v", offline, queued, err)
+		}
+
+		second, client2, nonce := pipe(t, conns, contracts.JsonRpc2, nil)
+		go wsutil.WriteClientBinary(client2, []byte(KeyPrefix+"Device\n"+
+			ProofPrefix+HandshakeProof([]byte("secret"), nonce, "Device")+"\n"+ResumePrefix+token+"\n"))
+		go second.Receive()
+		if msg, err := wsutil.ReadServerBinary(client2); err != nil || !strings.HasPrefix(string(msg), ResumedPrefix) {
+			t.Fatalf("Expected resumed session, got %s, %v", msg, err)
+		}
+		if msg, err := wsutil.ReadServerText(client2); err != nil || string(msg) != `{"jsonrpc":"2.0","method":"note"}` {
+			t.Errorf("offline queue %v: expected queued notification, got %s, %v", offline, msg, err)
+		}
+		client2.Close()
+	}
+}
+
+func TestEvents(t *testing.T) {
+	pool := gopool.NewPool(2, 1, 1)
+	conns := NewConnectionsManager(pool)
+	conns.Secrets = StaticKeySecretStore{"Device": []byte("secret")}
+	var events []*Event
+	conns.OnEvent(func(e *Event) { events = append(events, e) })
+
+	connection, client, nonce := pipe(t, conns, contracts.Legacy, nil)
+	defer client.Close()
+	if err := shakeHands(connection, client, "Device", HandshakeProof([]byte("secret"), nonce, "Device")); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	connection.Close()
+	conns.Remove(connection)
+
+	pending, client2, _ := pipe(t, conns, contracts.Legacy, nil)
+	defer client2.Close()
+	conns.Remove(pending)
+
+	want := []string{ConnectedEvent, KeyAssignedEvent, DisconnectedEvent, ConnectedEvent, DisconnectedEvent}
+	if len(events) != len(want) {
+		t.Fatalf("Got %d events; want %v", len(events), want)
+	}
+	for i, e := range events {
+		if e.Type != want[i] {
+			t.Errorf("Event %d is %s; want %s", i, e.Type, want[i])
+		}
+	}
+	if events[1].Key != "Device" || events[1].ConnectionId != connection.ConnectionId {
+		t.Errorf("Key assigned event %+v", events[1])
+	}
+}
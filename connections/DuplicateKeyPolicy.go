@@ -0,0 +1,41 @@
+package connections
+
+import "fmt"
+
+// DuplicateKeyPolicy decides what happens when a client completes the key
+// handshake with a key which already has a connection.
+type DuplicateKeyPolicy int
+
+const (
+	// EvictExisting closes the existing connection in favour of the new one.
+	EvictExisting DuplicateKeyPolicy = iota
+	// RejectDuplicate refuses the new connection.
+	RejectDuplicate
+	// AllowMultiple keeps all connections; requests to the key are sent to
+	// each of them.
+	AllowMultiple
+)
+
+var duplicateKeyPolicies = []DuplicateKeyPolicy{EvictExisting, RejectDuplicate, AllowMultiple}
+
+func (p DuplicateKeyPolicy) String() string {
+	switch p {
+	case EvictExisting:
+		return "evict"
+	case RejectDuplicate:
+		return "reject"
+	case AllowMultiple:
+		return "multiple"
+	}
+	return fmt.Sprintf("DuplicateKeyPolicy(%d)", int(p))
+}
+
+// ParseDuplicateKeyPolicy parses the name returned by DuplicateKeyPolicy.String.
+func ParseDuplicateKeyPolicy(s string) (DuplicateKeyPolicy, error) {
+	for _, p := range duplicateKeyPolicies {
+		if p.String() == s {
+			return p, nil
+		}
+	}
+	return EvictExisting, fmt.Errorf("unknown duplicate key policy '%s'", s)
+}
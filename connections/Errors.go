@@ -0,0 +1,47 @@
+package connections
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNotConnected is returned when there is no connection with a given key.
+var ErrNotConnected = errors.New("client not connected")
+
+// TimeoutError is returned when a client does not reply to a request before
+// the call deadline.
+type TimeoutError struct {
+	Key    string
+	Method string
+	ID     int
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("timed out waiting for reply to '%s' (id %d) from '%s'", e.Method, e.ID, e.Key)
+}
+
+// Timeout reports whether the error is a timeout. It makes TimeoutError
+// compatible with net.Error style checks.
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// ErrDuplicateKey is returned when a key is already connected and the
+// DuplicateKeyPolicy is RejectDuplicate.
+var ErrDuplicateKey = errors.New("key already connected")
+
+// ErrShuttingDown is returned for calls made while or after the
+// ConnectionsManager shuts down.
+var ErrShuttingDown = errors.New("shutting down")
+
+// ErrConnectionClosed is returned for calls to a connection which closed
+// before replying.
+var ErrConnectionClosed = errors.New("connection closed")
+
+// ErrRateLimited is returned by Receive when it closed a connection for
+// exceeding its rate limits.
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+// ErrMessageTooBig is returned by Receive when it closed a connection for
+// sending a frame larger than RateLimits.MaxMessageSize.
+var ErrMessageTooBig = errors.New("message too big")
@@ -0,0 +1,125 @@
+package connections
+
+import (
+	"context"
+	"time"
+
+	"github.com/spoconnor/Go-Client-Connector/contracts"
+	"github.com/spoconnor/Go-Client-Connector/metrics"
+)
+
+// Connection lifecycle events, passed to functions registered with OnEvent.
+// A connection resuming a session fires ConnectedEvent only; the session
+// keeps its key and connection id.
+const (
+	// ConnectedEvent is fired when a websocket is accepted, before the key
+	// handshake.
+	ConnectedEvent = "connected"
+	// KeyAssignedEvent is fired when a connection completes the key
+	// handshake.
+	KeyAssignedEvent = "key-assigned"
+	// DisconnectedEvent is fired when a connection is removed, or when its
+	// session ends without being resumed.
+	DisconnectedEvent = "disconnected"
+)
+
+// Events of requests sent to clients by SendToClient, SendToKeys and Gather.
+const (
+	// RpcSentEvent is fired when a request was written to a connection.
+	RpcSentEvent = "rpc-sent"
+	// RpcRepliedEvent is fired when the client replied, with a result or an
+	// error.
+	RpcRepliedEvent = "rpc-replied"
+	// RpcTimedOutEvent is fired when the client did not reply before the
+	// deadline.
+	RpcTimedOutEvent = "rpc-timed-out"
+)
+
+// Event describes something that happened to a connection.
+type Event struct {
+	Type         string
+	Key          string `json:",omitempty"` // empty before the key handshake
+	ConnectionId string
+	RemoteAddr   string
+	Properties   map[string]string `json:",omitempty"`
+	Connected    time.Time         // when the websocket was accepted
+	Time         time.Time
+	Method       string `json:",omitempty"` // of rpc events
+	RpcId        int    `json:",omitempty"` // of rpc events
+}
+
+// IsLifecycle reports whether e is a connection lifecycle event.
+func (e *Event) IsLifecycle() bool {
+	switch e.Type {
+	case ConnectedEvent, KeyAssignedEvent, DisconnectedEvent:
+		return true
+	}
+	return false
+}
+
+// OnEvent registers f to be called with every connection and rpc event.
+// f is called synchronously and must not block. OnEvent must be called
+// before connections are served.
+func (c *ConnectionsManager) OnEvent(f func(*Event)) {
+	c.listeners = append(c.listeners, f)
+}
+
+// emit tells the listeners about an event of connection.
+func (c *ConnectionsManager) emit(event string, connection *Connection) {
+	if len(c.listeners) == 0 {
+		return
+	}
+	c.fire(newEvent(event, connection))
+}
+
+// emitRpc tells the listeners about an event of the request with the given
+// method and id.
+func (c *ConnectionsManager) emitRpc(event string, connection *Connection, method string, id int) {
+	if len(c.listeners) == 0 {
+		return
+	}
+	e := newEvent(event, connection)
+	e.Method = method
+	e.RpcId = id
+	c.fire(e)
+}
+
+// replied tells listeners and metrics how the request with the given method
+// and id ended, after it was sent.
+func (c *ConnectionsManager) replied(connection *Connection, method string, id int, res *contracts.RpcResponse, err error) {
+	_, timeout := err.(*TimeoutError)
+	switch {
+	case err == nil:
+		c.emitRpc(RpcRepliedEvent, connection, method, id)
+		if res != nil && res.Error != nil {
+			metrics.RpcErrors.WithLabelValues(method).Inc()
+		}
+	case timeout || err == context.DeadlineExceeded:
+		c.emitRpc(RpcTimedOutEvent, connection, method, id)
+		metrics.RpcTimeouts.WithLabelValues(method).Inc()
+	default:
+		metrics.RpcErrors.WithLabelValues(method).Inc()
+	}
+}
+
+func (c *ConnectionsManager) fire(e *Event) {
+	for _, f := range c.listeners {
+		f(e)
+	}
+}
+
+func newEvent(event string, connection *Connection) *Event {
+	properties := make(map[string]string, len(connection.Properties))
+	for k, v := range connection.Properties {
+		properties[k] = v
+	}
+	return &Event{
+		Type:         event,
+		Key:          connection.Key,
+		ConnectionId: connection.ConnectionId,
+		RemoteAddr:   connection.remoteAddr,
+		Properties:   properties,
+		Connected:    connection.DateTimeUtc,
+		Time:         time.Now().UTC(),
+	}
+}
@@ -0,0 +1,84 @@
+package connections
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/spoconnor/Go-Client-Connector/contracts"
+	"github.com/spoconnor/Go-Client-Connector/metrics"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+// frames holds one message encoded as a text frame in every wire format, so
+// it can be fanned out to many connections without encoding it for each.
+type frames map[contracts.WireFormat][]byte
+
+func requestFrames(req *contracts.RpcRequest) (frames, error) {
+	f := make(frames, len(contracts.WireFormats))
+	for _, format := range contracts.WireFormats {
+		frame, err := requestFrame(format, req)
+		if err != nil {
+			return nil, err
+		}
+		f[format] = frame
+	}
+	return f, nil
+}
+
+// requestFrame encodes req as a text frame in the given wire format.
+func requestFrame(format contracts.WireFormat, req *contracts.RpcRequest) ([]byte, error) {
+	p, err := format.EncodeRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	w := wsutil.NewWriter(&buf, ws.StateServerSide, ws.OpText)
+	if _, err := w.Write(p); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// countFrames counts the frames in p, which holds whole frames, as sent in
+// direction.
+func countFrames(direction string, p []byte) {
+	r := bytes.NewReader(p)
+	for r.Len() > 0 {
+		h, err := ws.ReadHeader(r)
+		if err != nil || h.Length > int64(r.Len()) {
+			return
+		}
+		countFrame(direction, h.OpCode, h.Length)
+		r.Seek(h.Length, io.SeekCurrent)
+	}
+}
+
+// countFrame counts a frame with the given opcode and payload length.
+func countFrame(direction string, op ws.OpCode, length int64) {
+	name := opCodeName(op)
+	metrics.Frames.WithLabelValues(direction, name).Inc()
+	metrics.FrameBytes.WithLabelValues(direction, name).Add(float64(length))
+}
+
+func opCodeName(op ws.OpCode) string {
+	switch op {
+	case ws.OpContinuation:
+		return "continuation"
+	case ws.OpText:
+		return "text"
+	case ws.OpBinary:
+		return "binary"
+	case ws.OpClose:
+		return "close"
+	case ws.OpPing:
+		return "ping"
+	case ws.OpPong:
+		return "pong"
+	}
+	return "unknown"
+}
@@ -0,0 +1,96 @@
+package connections
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/spoconnor/Go-Client-Connector/contracts"
+	"github.com/spoconnor/Go-Client-Connector/logging"
+)
+
+// GatherResult is the answer of one connection to a gathered request.
+type GatherResult struct {
+	Key          string
+	ConnectionId string
+	KeyResult
+}
+
+// Gather sends a request to every registered connection whose Properties
+// contain all of filter, each with its own id, and streams the outcomes on
+// the returned channel. The channel is closed once every connection has
+// answered, ctx is done, or quorum connections replied with a result;
+// quorum 0 waits for all. Connections not answered by the deadline are
+// reported as TimedOut, those outstanding at the quorum are not reported.
+func (c *ConnectionsManager) Gather(
+	ctx context.Context, method string, params contracts.RpcParams,
+	filter map[string]string, quorum int) (<-chan *GatherResult, error) {
+
+	select {
+	case <-c.done:
+		return nil, ErrShuttingDown
+	default:
+	}
+
+	var targets []*Connection
+	c.mu.RLock()
+	for _, u := range c.us {
+		if matchProperties(u.Properties, filter) {
+			targets = append(targets, u)
+		}
+	}
+	c.mu.RUnlock()
+	logging.Message(slog.Default(), "[Gather] Sending", params, "method", method, "connections", len(targets))
+
+	ctx, cancel := context.WithCancel(ctx)
+	if _, has := ctx.Deadline(); !has && c.CallTimeout > 0 {
+		cancel()
+		ctx, cancel = context.WithTimeout(ctx, c.CallTimeout)
+	}
+
+	answers := make(chan *GatherResult, len(targets))
+	for _, u := range targets {
+		id := c.nextRequestId()
+		frame, err := requestFrame(u.format, &contracts.RpcRequest{ID: contracts.IntId(id), Method: method, Params: params})
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		s := &send{u: u, method: method, written: make(chan error, 1), reply: u.expectReply(ctx, id)}
+		c.pool.Schedule(func() {
+			s.written <- s.u.writeRaw(frame)
+		})
+		go func() {
+			r := s.await(ctx, id, true)
+			answers <- &GatherResult{Key: s.u.Key, ConnectionId: s.u.ConnectionId, KeyResult: *r}
+		}()
+	}
+
+	out := make(chan *GatherResult, len(targets))
+	go func() {
+		defer close(out)
+		defer cancel()
+		replied := 0
+		for range targets {
+			r := <-answers
+			out <- r
+			if r.Outcome == Replied {
+				replied++
+			}
+			if quorum > 0 && replied >= quorum {
+				slog.Debug("[Gather] Quorum reached", "method", method, "quorum", quorum)
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// matchProperties reports whether properties contain every entry of filter.
+func matchProperties(properties, filter map[string]string) bool {
+	for k, v := range filter {
+		if p, ok := properties[k]; !ok || p != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,101 @@
+package connections
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+// StartHeartbeat pings every connection each interval. Connections from which
+// no frame, pong or otherwise, arrived for misses intervals are closed and
+// removed. It stops on Shutdown.
+func (c *ConnectionsManager) StartHeartbeat(interval time.Duration, misses int) {
+	if interval <= 0 {
+		return
+	}
+	if misses < 1 {
+		misses = 1
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-ticker.C:
+				c.heartbeat(time.Duration(misses) * interval)
+			}
+		}
+	}()
+}
+
+// heartbeat evicts connections silent for longer than timeout and pings the
+// others.
+func (c *ConnectionsManager) heartbeat(timeout time.Duration) {
+	c.mu.RLock()
+	us := make([]*Connection, 0, len(c.us)+len(c.pending))
+	us = append(us, c.us...)
+	for u := range c.pending {
+		us = append(us, u)
+	}
+	c.mu.RUnlock()
+
+	now := time.Now()
+	for _, u := range us {
+		u := u // For closure.
+		if idle := u.idle(now); idle > timeout {
+			u.logger().Info("[ConnectionsManager.heartbeat] Evicting silent connection", "idle", idle)
+			u.Close()
+			c.Remove(u)
+			continue
+		}
+		c.pool.Schedule(func() {
+			if err := u.writePing(now); err != nil {
+				u.logger().Warn("[ConnectionsManager.heartbeat] Ping failed", "err", err)
+			}
+		})
+	}
+}
+
+// seen records that a frame was received.
+func (u *Connection) seen() {
+	u.mu.Lock()
+	u.lastSeen = time.Now().UTC()
+	u.mu.Unlock()
+}
+
+// idle returns for how long no frame was received.
+func (u *Connection) idle(now time.Time) time.Duration {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return now.Sub(u.lastSeen)
+}
+
+// writePing sends a ping frame carrying the send time, which the client
+// echoes in its pong.
+func (u *Connection) writePing(now time.Time) error {
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, uint64(now.UnixNano()))
+	frame, err := ws.CompileFrame(ws.NewPingFrame(payload))
+	if err != nil {
+		return err
+	}
+	return u.writeRaw(frame)
+}
+
+// pong records the round trip time of the ping the pong answers.
+func (u *Connection) pong(payload []byte) {
+	if len(payload) != 8 {
+		return // Unsolicited pong.
+	}
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(payload)))
+	rtt := time.Since(sent)
+	if rtt < 0 {
+		return
+	}
+	u.mu.Lock()
+	u.roundTrip = rtt
+	u.mu.Unlock()
+}
@@ -0,0 +1,74 @@
+package connections
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+)
+
+// ErrUnknownKey is returned by KeySecretStore for keys it has no secret for.
+var ErrUnknownKey = errors.New("unknown key")
+
+// KeySecretStore provides per-key secrets. During the key handshake a client
+// proves it knows the secret of the key it claims.
+type KeySecretStore interface {
+	// Secret returns the secret of key, or ErrUnknownKey.
+	Secret(key string) ([]byte, error)
+}
+
+// StaticKeySecretStore is a KeySecretStore backed by a map.
+type StaticKeySecretStore map[string][]byte
+
+func (s StaticKeySecretStore) Secret(key string) ([]byte, error) {
+	secret, ok := s[key]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return secret, nil
+}
+
+// LoadKeySecretStore reads a json object mapping keys to their secrets.
+func LoadKeySecretStore(path string) (StaticKeySecretStore, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var secrets map[string]string
+	if err := json.Unmarshal(data, &secrets); err != nil {
+		return nil, err
+	}
+	s := make(StaticKeySecretStore, len(secrets))
+	for key, secret := range secrets {
+		s[key] = []byte(secret)
+	}
+	return s, nil
+}
+
+// HandshakeProof computes the proof a client sends for key in reply to the
+// nonce of a key request: hex encoded HMAC-SHA256 of nonce followed by key,
+// keyed with the secret of key.
+func HandshakeProof(secret []byte, nonce, key string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(nonce))
+	mac.Write([]byte(key))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyProof checks proof against the secret of key.
+func verifyProof(store KeySecretStore, nonce, key, proof string) error {
+	if store == nil {
+		return errors.New("no key secrets configured")
+	}
+	secret, err := store.Secret(key)
+	if err != nil {
+		return err
+	}
+	want := HandshakeProof(secret, nonce, key)
+	if !hmac.Equal([]byte(want), []byte(proof)) {
+		return errors.New("invalid proof")
+	}
+	return nil
+}
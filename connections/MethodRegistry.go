@@ -0,0 +1,91 @@
+package connections
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/spoconnor/Go-Client-Connector/contracts"
+)
+
+// MethodHandler handles a request sent by a client. The returned value is
+// sent back as the result. A *contracts.RpcError is sent back as is, with its
+// code; any other error is reported as contracts.InternalError. ctx is
+// canceled when the connection closes or the manager shuts down.
+type MethodHandler func(ctx context.Context, conn *Connection, params contracts.RpcParams) (interface{}, error)
+
+// MethodRegistry maps method names to handlers of client initiated calls.
+type MethodRegistry struct {
+	mu       sync.RWMutex
+	handlers map[string]MethodHandler
+}
+
+func NewMethodRegistry() *MethodRegistry {
+	return &MethodRegistry{
+		handlers: make(map[string]MethodHandler),
+	}
+}
+
+// Register registers handler for method, replacing any previous one.
+func (r *MethodRegistry) Register(method string, handler MethodHandler) {
+	r.mu.Lock()
+	r.handlers[method] = handler
+	r.mu.Unlock()
+}
+
+// Unregister removes the handler of method.
+func (r *MethodRegistry) Unregister(method string) {
+	r.mu.Lock()
+	delete(r.handlers, method)
+	r.mu.Unlock()
+}
+
+// Lookup returns the handler of method.
+func (r *MethodRegistry) Lookup(method string) (MethodHandler, bool) {
+	r.mu.RLock()
+	h, ok := r.handlers[method]
+	r.mu.RUnlock()
+	return h, ok
+}
+
+// Methods returns names of all registered methods.
+func (r *MethodRegistry) Methods() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	res := make([]string, 0, len(r.handlers))
+	for m := range r.handlers {
+		res = append(res, m)
+	}
+	return res
+}
+
+// call runs the handler of req and returns the response to send back.
+func (r *MethodRegistry) call(ctx context.Context, conn *Connection, req *contracts.RpcRequest) (res *contracts.RpcResponse) {
+	res = &contracts.RpcResponse{ID: req.ID}
+
+	h, ok := r.Lookup(req.Method)
+	if !ok {
+		res.Error = contracts.NewRpcError(contracts.MethodNotFound, fmt.Sprintf("method '%s' not found", req.Method))
+		return res
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			conn.logger().Error("[MethodRegistry.call] Handler panicked", "method", req.Method, "panic", p)
+			res.Result = nil
+			res.Error = contracts.NewRpcError(contracts.InternalError, "internal error")
+		}
+	}()
+
+	result, err := h(ctx, conn, req.Params)
+	if err != nil {
+		if rpcErr, ok := err.(*contracts.RpcError); ok {
+			res.Error = rpcErr
+		} else {
+			res.Error = contracts.NewRpcError(contracts.InternalError, err.Error())
+		}
+		return res
+	}
+	res.Result = result
+	return res
+}
@@ -0,0 +1,191 @@
+package connections
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/spoconnor/Go-Client-Connector/contracts"
+	"github.com/spoconnor/Go-Client-Connector/logging"
+	"github.com/spoconnor/Go-Client-Connector/store"
+)
+
+// ErrQueueFull is returned when a key's offline queue is at its maximum depth.
+var ErrQueueFull = errors.New("offline queue full")
+
+// QueuedMessageDeadLetter is the kind of dead letters of expired queued
+// messages.
+const QueuedMessageDeadLetter = "queued-message"
+
+// OfflineQueue keeps notifications for keys which are not connected, until
+// they connect or the notifications expire. Expired notifications are kept
+// as dead letters.
+type OfflineQueue struct {
+	mu    sync.Mutex // serializes read-modify-write of queues
+	store store.Store
+
+	// TTL is how long messages are kept.
+	TTL time.Duration
+	// MaxDepth limits the number of messages kept per key.
+	MaxDepth int
+	// DeadLetterLimit is how many dead letters the store keeps.
+	DeadLetterLimit int
+}
+
+// NewOfflineQueue creates a queue keeping messages in s.
+func NewOfflineQueue(s store.Store, ttl time.Duration, maxDepth int) *OfflineQueue {
+	return &OfflineQueue{
+		store:           s,
+		TTL:             ttl,
+		MaxDepth:        maxDepth,
+		DeadLetterLimit: store.DefaultDeadLetterLimit,
+	}
+}
+
+// Push appends a message to the queue of key.
+func (q *OfflineQueue) Push(key, method string, params contracts.RpcParams) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now().UTC()
+	queue, err := q.live(key, now)
+	if err != nil {
+		return err
+	}
+	if q.MaxDepth > 0 && len(queue) >= q.MaxDepth {
+		return ErrQueueFull
+	}
+	return q.store.SetQueued(key, append(queue, store.QueuedMessage{
+		Method:  method,
+		Params:  params,
+		Queued:  now,
+		Expires: now.Add(q.TTL),
+	}))
+}
+
+// Peek returns the messages queued for key, oldest first.
+func (q *OfflineQueue) Peek(key string) ([]store.QueuedMessage, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.live(key, time.Now())
+}
+
+// Purge drops the messages queued for key and returns their number.
+func (q *OfflineQueue) Purge(key string) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	queue, err := q.live(key, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return len(queue), q.store.SetQueued(key, nil)
+}
+
+// take removes and returns the messages queued for key.
+func (q *OfflineQueue) take(key string) []store.QueuedMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	queue, err := q.live(key, time.Now())
+	if err == nil {
+		err = q.store.SetQueued(key, nil)
+	}
+	if err != nil {
+		slog.Warn("[OfflineQueue.take] Error", logging.KeyAttr, key, "err", err)
+		return nil
+	}
+	return queue
+}
+
+// requeue puts messages back in front of the queue of key.
+func (q *OfflineQueue) requeue(key string, msgs []store.QueuedMessage) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	queue, err := q.live(key, time.Now())
+	if err == nil {
+		err = q.store.SetQueued(key, append(append([]store.QueuedMessage(nil), msgs...), queue...))
+	}
+	if err != nil {
+		slog.Warn("[OfflineQueue.requeue] Error", logging.KeyAttr, key, "err", err)
+	}
+}
+
+// live moves expired messages of key to the dead letters and returns the
+// rest.
+// mutex must be held.
+func (q *OfflineQueue) live(key string, now time.Time) ([]store.QueuedMessage, error) {
+	queue, err := q.store.Queued(key)
+	if err != nil {
+		return nil, err
+	}
+	i := 0
+	for i < len(queue) && !queue[i].Expires.After(now) {
+		q.store.AddDeadLetter(&store.DeadLetter{
+			Kind:    QueuedMessageDeadLetter,
+			Key:     key,
+			Payload: queue[i],
+			Reason:  "expired",
+			Time:    now.UTC(),
+		}, q.DeadLetterLimit)
+		i++
+	}
+	if i == 0 {
+		return queue, nil
+	}
+	queue = queue[i:]
+	return queue, q.store.SetQueued(key, queue)
+}
+
+//-----------------------------------------------------------
+
+// QueueIfOffline queues a notification for key when it is not connected. It
+// reports whether the message was queued; when not, the key is connected and
+// the caller should send the message. A key whose session waits to be
+// resumed is offline: the message is queued and sent when the session is
+// resumed. Without an offline queue it is held by the session instead, and
+// ErrNotConnected is returned for other offline keys.
+func (c *ConnectionsManager) QueueIfOffline(key, method string, params contracts.RpcParams) (bool, error) {
+	// Holding the lock, the key can not connect and flush its queue before
+	// the message is queued.
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closing {
+		return false, ErrShuttingDown
+	}
+	if len(c.ns[key]) > 0 {
+		return false, nil
+	}
+	if c.Cluster != nil {
+		if _, ok := c.Cluster.Owner(key); ok {
+			return false, nil
+		}
+	}
+	if c.Offline == nil {
+		if held, err := c.holdLocked(key, method, params); held {
+			return err == nil, err
+		}
+		return false, ErrNotConnected
+	}
+	if err := c.Offline.Push(key, method, params); err != nil {
+		return false, err
+	}
+	logging.Message(slog.Default(), "[QueueIfOffline] Queued", params, logging.KeyAttr, key, "method", method)
+	return true, nil
+}
+
+// flush writes messages queued for the key of connection, in order. Messages
+// which could not be written are queued again.
+func (u *Connection) flush(queued []store.QueuedMessage) {
+	if len(queued) == 0 {
+		return
+	}
+	u.logger().Info("[Connection.flush] Sending queued messages", "count", len(queued))
+	for i, m := range queued {
+		if err := u.writeNotice(m.Method, m.Params); err != nil {
+			u.logger().Warn("[Connection.flush] Error", "err", err)
+			if q := u.connectionsManager.Offline; q != nil {
+				q.requeue(u.Key, queued[i:])
+			}
+			return
+		}
+	}
+}
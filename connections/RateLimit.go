@@ -0,0 +1,175 @@
+package connections
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/spoconnor/Go-Client-Connector/metrics"
+)
+
+// RateLimitAction decides what happens to a message exceeding the rate
+// limits of its connection.
+type RateLimitAction int
+
+const (
+	// DropMessage discards the message unread. Responses to calls in it
+	// are lost too, the calls time out.
+	DropMessage RateLimitAction = iota
+	// ReplyError discards the message unread and answers a text message
+	// with a ServerError of null id. Responses to calls in it are lost too.
+	ReplyError
+	// CloseConnection closes the connection with a policy violation.
+	CloseConnection
+)
+
+var rateLimitActions = []RateLimitAction{DropMessage, ReplyError, CloseConnection}
+
+func (a RateLimitAction) String() string {
+	switch a {
+	case DropMessage:
+		return "drop"
+	case ReplyError:
+		return "error"
+	case CloseConnection:
+		return "close"
+	}
+	return fmt.Sprintf("RateLimitAction(%d)", int(a))
+}
+
+// ParseRateLimitAction parses the name returned by RateLimitAction.String.
+func ParseRateLimitAction(s string) (RateLimitAction, error) {
+	for _, a := range rateLimitActions {
+		if a.String() == s {
+			return a, nil
+		}
+	}
+	return DropMessage, fmt.Errorf("unknown rate limit action '%s'", s)
+}
+
+// Limits exceeded by a message.
+const (
+	MessagesLimit = "messages"
+	BytesLimit    = "bytes"
+	SizeLimit     = "size"
+)
+
+// DefaultMaxMessageSize is the default of RateLimits.MaxMessageSize.
+const DefaultMaxMessageSize = 1 << 20
+
+// RateLimits bound the frames every connection may send, control frames
+// included. Each limit is a token bucket refilled at its rate and holding up
+// to its burst; a zero rate disables the limit and a zero burst is one second
+// worth of the rate. Messages larger than the byte burst always exceed the
+// limit. A frame larger than MaxMessageSize closes the connection, whatever
+// the Action.
+type RateLimits struct {
+	Messages       int // per second
+	MessageBurst   int
+	Bytes          int // per second
+	ByteBurst      int
+	Action         RateLimitAction
+	MaxMessageSize int // bytes of a frame; 0 is unlimited
+}
+
+func (l *RateLimits) enabled() bool {
+	return l.Messages > 0 || l.Bytes > 0
+}
+
+func burst(rate, burst int) float64 {
+	if burst <= 0 {
+		return float64(rate)
+	}
+	return float64(burst)
+}
+
+// SetRateLimits replaces the rate limits of all connections, which may be
+// receiving. Tokens left in their buckets are kept.
+func (c *ConnectionsManager) SetRateLimits(l RateLimits) {
+	c.limits.Store(&l)
+}
+
+// RateLimits returns the current rate limits.
+func (c *ConnectionsManager) RateLimits() RateLimits {
+	if l, ok := c.limits.Load().(*RateLimits); ok {
+		return *l
+	}
+	return RateLimits{}
+}
+
+// tokenBucket holds the tokens of one limit of a connection.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time // of the last refill; zero before the first one
+}
+
+// has reports whether the bucket holds n tokens, after refilling it for the
+// time since the last refill.
+func (b *tokenBucket) has(n, rate, burst float64, now time.Time) bool {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+	return b.tokens >= n
+}
+
+// take takes n tokens, which has reported the bucket holds.
+func (b *tokenBucket) take(n float64) {
+	b.tokens -= n
+}
+
+// tooBig reports whether a frame of length bytes exceeds the maximum message
+// size, counting it when it does.
+func (u *Connection) tooBig(length int64) bool {
+	max := u.connectionsManager.RateLimits().MaxMessageSize
+	if max <= 0 || length <= int64(max) {
+		return false
+	}
+	metrics.RateLimited.WithLabelValues(SizeLimit, CloseConnection.String()).Inc()
+	u.logger().Warn("[Connection.tooBig] Message too big", "bytes", length, "max", max)
+	return true
+}
+
+// allow takes a message of length bytes, received at now, from the buckets
+// of u. When it exceeds a limit, it returns false and the action to take,
+// taking nothing from either bucket.
+func (u *Connection) allow(length int64, now time.Time) (RateLimitAction, bool) {
+	l := u.connectionsManager.RateLimits()
+	if !l.enabled() {
+		return DropMessage, true
+	}
+	var exceeded string
+	u.mu.Lock()
+	switch {
+	case l.Messages > 0 && !u.messages.has(1, float64(l.Messages), burst(l.Messages, l.MessageBurst), now):
+		exceeded = MessagesLimit
+	case l.Bytes > 0 && !u.bytes.has(float64(length), float64(l.Bytes), burst(l.Bytes, l.ByteBurst), now):
+		exceeded = BytesLimit
+	}
+	if exceeded != "" {
+		u.rateLimited++
+	} else {
+		if l.Messages > 0 {
+			u.messages.take(1)
+		}
+		if l.Bytes > 0 {
+			u.bytes.take(float64(length))
+		}
+	}
+	first := u.rateLimited == 1
+	u.mu.Unlock()
+	if exceeded == "" {
+		return DropMessage, true
+	}
+
+	metrics.RateLimited.WithLabelValues(exceeded, l.Action.String()).Inc()
+	// A flooding client would flood the log too.
+	if first {
+		u.logger().Warn("[Connection.allow] Rate limit exceeded", "limit", exceeded, "action", l.Action.String(), "bytes", length)
+	} else {
+		u.debug("[Connection.allow] Rate limit exceeded", "limit", exceeded, "action", l.Action.String(), "bytes", length)
+	}
+	return l.Action, false
+}
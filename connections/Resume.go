@@ -0,0 +1,292 @@
+package connections
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/spoconnor/Go-Client-Connector/contracts"
+	"github.com/spoconnor/Go-Client-Connector/logging"
+	"github.com/spoconnor/Go-Client-Connector/store"
+
+	"github.com/gobwas/ws"
+)
+
+// Session resumption. When ResumeGrace is set, a connection completing the
+// key handshake is sent SessionPrefix followed by a resume token in a binary
+// frame. A client reconnecting within ResumeGrace of a drop may add a third
+// line to its handshake answer, ResumePrefix followed by the token. With a
+// valid token the new connection takes over the session: its connection id,
+// properties, topic subscriptions, notifications sent in the meantime and
+// calls still awaiting a reply. It is then sent ResumedPrefix followed by a
+// new token, and no presence events are recorded. Otherwise it starts a new
+// session as usual.
+const (
+	ResumePrefix  = "ClientResume:"
+	SessionPrefix = "ClientSession:"
+	ResumedPrefix = "ClientResumed:"
+)
+
+// suspendedNotices limits the notifications held for a suspended session.
+const suspendedNotices = 100
+
+// session is the resumable state of a registered connection.
+type session struct {
+	token string
+	u     *Connection
+
+	// Set while the connection is dropped and the session waits to be
+	// resumed.
+	timer   *time.Timer
+	filters []string              // topic subscriptions
+	notices []store.QueuedMessage // sent in the meantime
+}
+
+// newSession issues a resume token for a registered connection. It returns
+// "" when resumption is disabled.
+// mutex must be held.
+func (c *ConnectionsManager) newSession(connection *Connection) string {
+	if c.ResumeGrace <= 0 {
+		return ""
+	}
+	token, err := newNonce()
+	if err != nil {
+		connection.logger().Error("[ConnectionsManager.newSession] Error", "err", err)
+		return ""
+	}
+	c.sessions[token] = &session{token: token, u: connection}
+	connection.mu.Lock()
+	connection.resumeToken = token
+	connection.mu.Unlock()
+	return token
+}
+
+// suspend keeps the session of a removed connection for ResumeGrace. It
+// reports whether the connection had a session to keep.
+// mutex must be held.
+func (c *ConnectionsManager) suspend(connection *Connection, filters []string) bool {
+	s := c.sessions[connection.token()]
+	if s == nil || s.u != connection || c.ResumeGrace <= 0 {
+		return false
+	}
+	s.filters = filters
+	s.timer = time.AfterFunc(c.ResumeGrace, func() { c.expire(s) })
+	c.suspended[connection.Key] = append(c.suspended[connection.Key], s)
+	return true
+}
+
+// unsuspend forgets a suspended session.
+// mutex must be held.
+func (c *ConnectionsManager) unsuspend(s *session) {
+	delete(c.sessions, s.token)
+	if s.timer == nil {
+		return
+	}
+	s.timer.Stop()
+	list := c.suspended[s.u.Key]
+	for i, other := range list {
+		if other == s {
+			list = append(list[:i:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(c.suspended, s.u.Key)
+	} else {
+		c.suspended[s.u.Key] = list
+	}
+}
+
+// expire ends a session which was not resumed in time. Its held
+// notifications are queued for the key, or kept as dead letters.
+func (c *ConnectionsManager) expire(s *session) {
+	c.mu.Lock()
+	if c.sessions[s.token] != s {
+		c.mu.Unlock()
+		return
+	}
+	c.unsuspend(s)
+	closing := c.closing
+	c.mu.Unlock()
+
+	s.u.logger().Info("[ConnectionsManager.expire] Session was not resumed")
+	s.u.end(nil)
+	c.disconnected(s.u)
+	c.keepNotices(s.u.Key, s.notices)
+	if closing {
+		return
+	}
+	c.Broadcast("goodbye", contracts.RpcParams{
+		"name": s.u.Key,
+		"time": timestamp(),
+	})
+}
+
+// keepNotices queues notifications of an ended session.
+func (c *ConnectionsManager) keepNotices(key string, notices []store.QueuedMessage) {
+	for _, m := range notices {
+		reason := "session expired"
+		if c.Offline != nil {
+			err := c.Offline.Push(key, m.Method, m.Params)
+			if err == nil {
+				continue
+			}
+			reason = err.Error()
+		}
+		c.Store.AddDeadLetter(&store.DeadLetter{
+			Kind:    QueuedMessageDeadLetter,
+			Key:     key,
+			Payload: m,
+			Reason:  reason,
+			Time:    time.Now().UTC(),
+		}, c.DeadLetterLimit)
+	}
+}
+
+// hold keeps a notification for the suspended sessions of key. It reports
+// whether there were any.
+func (c *ConnectionsManager) hold(key, method string, params contracts.RpcParams) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.holdLocked(key, method, params)
+}
+
+// holdLocked is hold with the mutex held.
+func (c *ConnectionsManager) holdLocked(key, method string, params contracts.RpcParams) (bool, error) {
+	ss := c.suspended[key]
+	if len(ss) == 0 {
+		return false, nil
+	}
+	now := time.Now().UTC()
+	for _, s := range ss {
+		if len(s.notices) >= suspendedNotices {
+			return true, ErrQueueFull
+		}
+	}
+	for _, s := range ss {
+		s.notices = append(s.notices, store.QueuedMessage{Method: method, Params: params, Queued: now, Expires: now.Add(c.ResumeGrace)})
+	}
+	slog.Debug("[ConnectionsManager.hold] Holding for suspended session", logging.KeyAttr, key, "method", method)
+	return true, nil
+}
+
+// resume lets connection take over the session with the given token. It
+// reports false, leaving connection untouched, when the token is unknown or
+// belongs to another key. The previous connection is closed if it is still
+// registered, as happens when the server did not notice the drop yet.
+func (c *ConnectionsManager) resume(connection *Connection, key, token string) (bool, error) {
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		return false, ErrShuttingDown
+	}
+	s := c.sessions[token]
+	if s == nil || s.u.Key != key {
+		c.mu.Unlock()
+		return false, nil
+	}
+	previous := s.u
+	filters, notices, live := s.filters, s.notices, s.timer == nil
+	if live {
+		filters = previous.subscriptions()
+		c.remove(previous)
+	}
+	c.unsuspend(s)
+
+	connection.id = c.seq
+	connection.Key = key
+	connection.ConnectionId = previous.ConnectionId
+	connection.DateTimeUtc = previous.DateTimeUtc
+	for k, v := range previous.Properties {
+		if _, ok := connection.Properties[k]; !ok {
+			connection.Properties[k] = v
+		}
+	}
+	connection.logger().Info("[ConnectionsManager.resume] Resuming session")
+	c.us = append(c.us, connection)
+	c.ns[key] = append(c.ns[key], connection)
+	delete(c.pending, connection)
+	c.seq++
+	for _, filter := range filters {
+		c.subscribeLocked(connection, filter)
+	}
+	next := c.newSession(connection)
+	var queued []store.QueuedMessage
+	if c.Offline != nil {
+		queued = c.Offline.take(key)
+	}
+	c.mu.Unlock()
+
+	previous.end(connection)
+	if live {
+		previous.writeClose(ws.StatusPolicyViolation, "Resumed by a new connection")
+		previous.Close()
+	}
+	connection.writeBinary([]byte(ResumedPrefix + next))
+	connection.flush(append(notices, queued...))
+	return true, nil
+}
+
+// endSuspended ends the suspended sessions of key, returning their held
+// notifications. It is used when the key starts a new session.
+// mutex must be held.
+func (c *ConnectionsManager) endSuspended(key string) ([]*Connection, []store.QueuedMessage) {
+	var (
+		ended   []*Connection
+		notices []store.QueuedMessage
+	)
+	for _, s := range c.suspended[key] {
+		s.timer.Stop()
+		delete(c.sessions, s.token)
+		ended = append(ended, s.u)
+		notices = append(notices, s.notices...)
+	}
+	delete(c.suspended, key)
+	return ended, notices
+}
+
+//-----------------------------------------------------------
+
+// token returns the resume token of the connection, if any.
+func (u *Connection) token() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.resumeToken
+}
+
+// end marks the session of the connection as over, or as taken over by next.
+// Calls awaiting replies fail, or move on to next.
+func (u *Connection) end(next *Connection) {
+	u.endOnce.Do(func() {
+		if next != nil {
+			u.mu.Lock()
+			moved := u.awaitingReply
+			u.awaitingReply = make(map[int]awaiting)
+			u.successor = next
+			u.mu.Unlock()
+
+			next.mu.Lock()
+			for id, c := range moved {
+				next.awaitingReply[id] = c
+			}
+			next.mu.Unlock()
+		}
+		close(u.ended)
+	})
+}
+
+// next returns the connection which took over the session, if any.
+func (u *Connection) next() *Connection {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.successor
+}
+
+// subscriptions returns the topic filters of the connection.
+// manager mutex must be held.
+func (u *Connection) subscriptions() []string {
+	filters := make([]string, 0, len(u.topics))
+	for filter := range u.topics {
+		filters = append(filters, filter)
+	}
+	return filters
+}
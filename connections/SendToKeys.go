@@ -0,0 +1,197 @@
+package connections
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/spoconnor/Go-Client-Connector/contracts"
+	"github.com/spoconnor/Go-Client-Connector/logging"
+)
+
+// Outcome tells what happened to a message sent to one key.
+type Outcome string
+
+const (
+	// Delivered means the message was written, no reply was awaited.
+	Delivered Outcome = "delivered"
+	// NotConnected means no connection had the key.
+	NotConnected Outcome = "not-connected"
+	// Replied means the client replied with a result.
+	Replied Outcome = "replied"
+	// Errored means the client replied with an error, or the message could
+	// not be written.
+	Errored Outcome = "errored"
+	// TimedOut means the deadline passed before the write or reply.
+	TimedOut Outcome = "timed-out"
+)
+
+// rank orders outcomes for keys with several connections; the best one is
+// reported.
+func (o Outcome) rank() int {
+	switch o {
+	case Replied:
+		return 4
+	case Errored:
+		return 3
+	case Delivered:
+		return 2
+	case TimedOut:
+		return 1
+	}
+	return 0
+}
+
+// KeyResult is the outcome of sending a message to one key.
+type KeyResult struct {
+	Outcome Outcome
+	Result  interface{}         `json:",omitempty"`
+	Error   *contracts.RpcError `json:",omitempty"`
+}
+
+// SendToKeys sends the same request to all connections of each key. The
+// request is encoded once per wire format and written on the pool; keys
+// connected to other nodes of the cluster are forwarded to them. When
+// waitForReply is set, replies are awaited until ctx is done, or CallTimeout
+// when ctx has no deadline.
+func (c *ConnectionsManager) SendToKeys(
+	ctx context.Context, keys []string, method string,
+	params contracts.RpcParams, waitForReply bool) (map[string]*KeyResult, error) {
+
+	logging.Message(slog.Default(), "[SendToKeys] Sending", params, "method", method, "keys", len(keys))
+
+	select {
+	case <-c.done:
+		return nil, ErrShuttingDown
+	default:
+	}
+
+	id := c.nextRequestId()
+	f, err := requestFrames(&contracts.RpcRequest{ID: contracts.IntId(id), Method: method, Params: params})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, has := ctx.Deadline(); !has && c.CallTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.CallTimeout)
+		defer cancel()
+	}
+
+	results := make(map[string]*KeyResult, len(keys))
+	sends := make(map[string][]*send, len(keys))
+	remote := make(map[string]chan *KeyResult) // keys connected to other nodes
+	for _, key := range keys {
+		if _, dup := results[key]; dup {
+			continue
+		}
+		if node, ok := c.remoteOwner(key); ok {
+			key := key // For closure.
+			forwarded := make(chan *KeyResult, 1)
+			go func() {
+				forwarded <- keyResult(c.Cluster.Forward(ctx, node, key, method, params, waitForReply))
+			}()
+			remote[key] = forwarded
+			results[key] = nil
+			continue
+		}
+		us := c.connections(key)
+		if len(us) == 0 {
+			results[key] = &KeyResult{Outcome: NotConnected}
+			continue
+		}
+		results[key] = nil
+		for _, u := range us {
+			s := &send{u: u, method: method, written: make(chan error, 1)}
+			if waitForReply {
+				s.reply = u.expectReply(ctx, id)
+			}
+			data := f[u.format] // For closure.
+			c.pool.Schedule(func() {
+				s.written <- s.u.writeRaw(data)
+			})
+			sends[key] = append(sends[key], s)
+		}
+	}
+
+	for key, ss := range sends {
+		var best *KeyResult
+		for _, s := range ss {
+			r := s.await(ctx, id, waitForReply)
+			if best == nil || r.Outcome.rank() > best.Outcome.rank() {
+				best = r
+			}
+		}
+		results[key] = best
+	}
+	for key, forwarded := range remote {
+		results[key] = <-forwarded
+	}
+	return results, nil
+}
+
+// send is a request written to one connection.
+type send struct {
+	u       *Connection
+	method  string
+	written chan error
+	reply   <-chan *contracts.RpcResponse // nil when no reply is awaited
+}
+
+// await waits for the write and, when awaited, the reply. Results which are
+// ready win over a passed deadline.
+func (s *send) await(ctx context.Context, id int, waitForReply bool) *KeyResult {
+	var err error
+	select {
+	case err = <-s.written:
+	default:
+		select {
+		case err = <-s.written:
+		case <-ctx.Done():
+			if waitForReply {
+				s.u.cancelReply(id)
+			}
+			return &KeyResult{Outcome: TimedOut}
+		}
+	}
+	if err != nil {
+		if waitForReply {
+			s.u.cancelReply(id)
+		}
+		return &KeyResult{Outcome: Errored, Error: contracts.NewRpcError(contracts.ServerError, err.Error())}
+	}
+	c := s.u.connectionsManager
+	c.emitRpc(RpcSentEvent, s.u, s.method, id)
+	if !waitForReply {
+		return &KeyResult{Outcome: Delivered}
+	}
+
+	var res *contracts.RpcResponse
+	select {
+	case res = <-s.reply:
+		s.u.cancelReply(id)
+	default:
+		res, err = s.u.AwaitReply(ctx, id, s.reply)
+	}
+	c.replied(s.u, s.method, id, res, err)
+	return keyResult(res, err)
+}
+
+// keyResult returns the outcome of a call which returned res and err.
+func keyResult(res *contracts.RpcResponse, err error) *KeyResult {
+	switch {
+	case err == ErrNotConnected:
+		return &KeyResult{Outcome: NotConnected}
+	case err == nil && res == nil:
+		return &KeyResult{Outcome: Delivered}
+	case err == nil && res.Error != nil:
+		return &KeyResult{Outcome: Errored, Error: res.Error}
+	case err == nil:
+		return &KeyResult{Outcome: Replied, Result: res.Result}
+	case err == context.DeadlineExceeded:
+		return &KeyResult{Outcome: TimedOut}
+	}
+	if _, ok := err.(*TimeoutError); ok {
+		return &KeyResult{Outcome: TimedOut}
+	}
+	return &KeyResult{Outcome: Errored, Error: contracts.NewRpcError(contracts.ServerError, err.Error())}
+}
@@ -0,0 +1,319 @@
+package connections
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"github.com/spoconnor/Go-Client-Connector/contracts"
+	"github.com/spoconnor/Go-Client-Connector/logging"
+)
+
+// Topic names are hierarchical, with levels separated by '/', as in MQTT.
+// Subscriptions are to topic filters, which may use wildcards: '+' matches
+// exactly one level and '#', as the last level, matches any number of
+// remaining levels, including none. For example "news/+/today" matches
+// "news/sport/today" and "news/#" matches "news" and "news/sport/today".
+
+// Methods clients call to manage their topic subscriptions. Both take the
+// topic filter as the "topic" parameter.
+const (
+	SubscribeMethod   = "subscribe"
+	UnsubscribeMethod = "unsubscribe"
+)
+
+// Topic wildcards.
+const (
+	TopicSeparator      = "/"
+	SingleLevelWildcard = "+"
+	MultiLevelWildcard  = "#"
+)
+
+// DefaultTopicHistory is how many messages are retained per topic by default.
+const DefaultTopicHistory = 1
+
+// DefaultRetainedTopics is how many topics messages are retained on by
+// default.
+const DefaultRetainedTopics = 10000
+
+// ErrInvalidTopic is returned for empty topic names, topic names with
+// wildcards and malformed topic filters.
+var ErrInvalidTopic = errors.New("invalid topic")
+
+// registerTopicMethods registers the subscription methods on c.Methods.
+func (c *ConnectionsManager) registerTopicMethods() {
+	c.Methods.Register(SubscribeMethod, func(ctx context.Context, conn *Connection, params contracts.RpcParams) (interface{}, error) {
+		topic, err := params.String("topic")
+		if err != nil {
+			return nil, err
+		}
+		if err := c.Subscribe(conn, topic); err != nil {
+			return nil, contracts.NewRpcError(contracts.InvalidParams, err.Error())
+		}
+		return true, nil
+	})
+	c.Methods.Register(UnsubscribeMethod, func(ctx context.Context, conn *Connection, params contracts.RpcParams) (interface{}, error) {
+		topic, err := params.String("topic")
+		if err != nil {
+			return nil, err
+		}
+		return c.Unsubscribe(conn, topic), nil
+	})
+}
+
+// Subscribe subscribes a registered connection to a topic filter. Messages
+// retained on matching topics are sent to the connection right away.
+func (c *ConnectionsManager) Subscribe(connection *Connection, filter string) error {
+	if !validTopicFilter(filter) {
+		return ErrInvalidTopic
+	}
+	c.mu.Lock()
+	if !c.registered(connection) {
+		c.mu.Unlock()
+		return ErrNotConnected
+	}
+	c.subscribeLocked(connection, filter)
+	retained := c.retainedFor(filter)
+	c.mu.Unlock()
+
+	connection.logger().Info("[ConnectionsManager.Subscribe] Subscribed", "filter", filter, "retained", len(retained))
+	if len(retained) > 0 {
+		c.pool.Schedule(func() {
+			for _, f := range retained {
+				if err := connection.writeRaw(f[connection.format]); err != nil {
+					return
+				}
+			}
+		})
+	}
+	return nil
+}
+
+// Unsubscribe unsubscribes connection from topic. It reports whether the
+// connection was subscribed.
+func (c *ConnectionsManager) Unsubscribe(connection *Connection, topic string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := connection.topics[topic]; !ok {
+		return false
+	}
+	c.unsubscribe(connection, topic)
+	connection.logger().Info("[ConnectionsManager.Unsubscribe] Unsubscribed", "topic", topic)
+	return true
+}
+
+// Subscribers describes connections with a subscription matching topic.
+func (c *ConnectionsManager) Subscribers(topic string) []ConnectionInfo {
+	us := c.subscribers(topic)
+	res := make([]ConnectionInfo, len(us))
+	for i, u := range us {
+		res[i] = u.Info()
+	}
+	return res
+}
+
+// Publish sends a notification to connections with a subscription matching
+// topic, on every node of the cluster, and retains it for future
+// subscribers. It returns the number of subscribers on this node the message
+// was sent to.
+func (c *ConnectionsManager) Publish(topic, method string, params contracts.RpcParams) (int, error) {
+	n, err := c.PublishLocal(topic, method, params)
+	if err == nil && c.Cluster != nil {
+		c.Cluster.Publish(topic, method, params)
+	}
+	return n, err
+}
+
+// PublishLocal is Publish for connections of this node only. The message is
+// encoded once per wire format.
+func (c *ConnectionsManager) PublishLocal(topic, method string, params contracts.RpcParams) (int, error) {
+	if !validTopic(topic) {
+		return 0, ErrInvalidTopic
+	}
+	f, err := requestFrames(&contracts.RpcRequest{Method: method, Params: params})
+	if err != nil {
+		return 0, err
+	}
+	select {
+	case <-c.done:
+		return 0, ErrShuttingDown
+	default:
+	}
+
+	// Retaining and collecting subscribers under one lock, a concurrent
+	// subscriber gets the message either as retained or published, not both.
+	c.mu.Lock()
+	c.retain(topic, f)
+	us := c.subscribersLocked(topic)
+	c.mu.Unlock()
+
+	for _, u := range us {
+		u := u             // For closure.
+		bts := f[u.format] // For closure.
+		c.pool.Schedule(func() {
+			u.writeRaw(bts)
+		})
+	}
+	logging.Message(slog.Default(), "[ConnectionsManager.Publish] Published", params, "topic", topic, "method", method, "subscribers", len(us))
+	return len(us), nil
+}
+
+// subscribers returns connections with a subscription matching topic.
+func (c *ConnectionsManager) subscribers(topic string) []*Connection {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.subscribersLocked(topic)
+}
+
+// subscribersLocked returns connections with a subscription matching topic,
+// ordered by id.
+// mutex must be held.
+func (c *ConnectionsManager) subscribersLocked(topic string) []*Connection {
+	seen := make(map[*Connection]struct{})
+	for filter, subscribers := range c.topics {
+		if !matchTopic(filter, topic) {
+			continue
+		}
+		for u := range subscribers {
+			seen[u] = struct{}{}
+		}
+	}
+	us := make([]*Connection, 0, len(seen))
+	for u := range seen {
+		us = append(us, u)
+	}
+	sort.Slice(us, func(i, j int) bool { return us[i].id < us[j].id })
+	return us
+}
+
+// retainedTopic holds the messages retained on a topic, oldest first.
+type retainedTopic struct {
+	topic    string
+	messages []frames
+}
+
+// retain keeps f as the latest message of topic, dropping the oldest one
+// beyond TopicHistory and the least recently published topic beyond
+// RetainedTopics.
+// mutex must be held.
+func (c *ConnectionsManager) retain(topic string, f frames) {
+	history := c.TopicHistory
+	if history < 1 {
+		history = 1
+	}
+	e, ok := c.retained[topic]
+	if ok {
+		c.recent.MoveToBack(e)
+	} else {
+		e = c.recent.PushBack(&retainedTopic{topic: topic})
+		c.retained[topic] = e
+	}
+	r := e.Value.(*retainedTopic)
+	kept := append(r.messages, f)
+	if len(kept) > history {
+		kept = append([]frames(nil), kept[len(kept)-history:]...)
+	}
+	r.messages = kept
+
+	limit := c.RetainedTopics
+	if limit < 1 {
+		limit = 1
+	}
+	for c.recent.Len() > limit {
+		oldest := c.recent.Remove(c.recent.Front()).(*retainedTopic)
+		delete(c.retained, oldest.topic)
+	}
+}
+
+// retainedFor returns messages retained on topics matching filter, oldest
+// first within each topic.
+// mutex must be held.
+func (c *ConnectionsManager) retainedFor(filter string) []frames {
+	topics := make([]string, 0)
+	for topic := range c.retained {
+		if matchTopic(filter, topic) {
+			topics = append(topics, topic)
+		}
+	}
+	sort.Strings(topics)
+	var res []frames
+	for _, topic := range topics {
+		res = append(res, c.retained[topic].Value.(*retainedTopic).messages...)
+	}
+	return res
+}
+
+// mutex must be held.
+func (c *ConnectionsManager) subscribeLocked(connection *Connection, filter string) {
+	subscribers := c.topics[filter]
+	if subscribers == nil {
+		subscribers = make(map[*Connection]struct{})
+		c.topics[filter] = subscribers
+	}
+	subscribers[connection] = struct{}{}
+	if connection.topics == nil {
+		connection.topics = make(map[string]struct{})
+	}
+	connection.topics[filter] = struct{}{}
+}
+
+// mutex must be held.
+func (c *ConnectionsManager) unsubscribe(connection *Connection, topic string) {
+	delete(connection.topics, topic)
+	if subscribers := c.topics[topic]; subscribers != nil {
+		delete(subscribers, connection)
+		if len(subscribers) == 0 {
+			delete(c.topics, topic)
+		}
+	}
+}
+
+// unsubscribeAll removes all subscriptions of connection.
+// mutex must be held.
+func (c *ConnectionsManager) unsubscribeAll(connection *Connection) {
+	for topic := range connection.topics {
+		c.unsubscribe(connection, topic)
+	}
+}
+
+// validTopic reports whether topic can be published to.
+func validTopic(topic string) bool {
+	return topic != "" && !strings.ContainsAny(topic, SingleLevelWildcard+MultiLevelWildcard)
+}
+
+// validTopicFilter reports whether filter can be subscribed to.
+func validTopicFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	levels := strings.Split(filter, TopicSeparator)
+	for i, level := range levels {
+		if level == MultiLevelWildcard && i == len(levels)-1 || level == SingleLevelWildcard {
+			continue
+		}
+		if strings.ContainsAny(level, SingleLevelWildcard+MultiLevelWildcard) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchTopic reports whether topic matches filter.
+func matchTopic(filter, topic string) bool {
+	fs := strings.Split(filter, TopicSeparator)
+	ts := strings.Split(topic, TopicSeparator)
+	for i, f := range fs {
+		if f == MultiLevelWildcard {
+			return true
+		}
+		if i >= len(ts) {
+			return false
+		}
+		if f != SingleLevelWildcard && f != ts[i] {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
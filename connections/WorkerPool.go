@@ -0,0 +1,77 @@
+package connections
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/spoconnor/Go-Client-Connector/metrics"
+)
+
+// Scheduler runs tasks on a pool of goroutines. gopool.Pool implements it.
+type Scheduler interface {
+	Schedule(task func())
+	ScheduleTimeout(timeout time.Duration, task func()) error
+}
+
+// WorkerPool wraps a Scheduler to keep track of scheduled tasks, so they can
+// be drained on shutdown.
+type WorkerPool struct {
+	pool   Scheduler
+	tasks  int64 // scheduled and not yet finished
+	queued int64 // scheduled and not yet started
+}
+
+func NewWorkerPool(pool Scheduler) *WorkerPool {
+	return &WorkerPool{pool: pool}
+}
+
+func (p *WorkerPool) Schedule(task func()) {
+	atomic.AddInt64(&p.tasks, 1)
+	atomic.AddInt64(&p.queued, 1)
+	p.pool.Schedule(p.track(task))
+}
+
+func (p *WorkerPool) ScheduleTimeout(timeout time.Duration, task func()) error {
+	atomic.AddInt64(&p.tasks, 1)
+	atomic.AddInt64(&p.queued, 1)
+	err := p.pool.ScheduleTimeout(timeout, p.track(task))
+	if err != nil {
+		atomic.AddInt64(&p.tasks, -1)
+		atomic.AddInt64(&p.queued, -1)
+		metrics.ScheduleRejections.Inc()
+	}
+	return err
+}
+
+// Tasks returns the number of scheduled tasks which have not finished yet.
+func (p *WorkerPool) Tasks() int64 {
+	return atomic.LoadInt64(&p.tasks)
+}
+
+// Queued returns the number of scheduled tasks waiting for a worker.
+func (p *WorkerPool) Queued() int64 {
+	return atomic.LoadInt64(&p.queued)
+}
+
+// Wait blocks until all scheduled tasks finished or ctx is done.
+func (p *WorkerPool) Wait(ctx context.Context) error {
+	ticker := time.NewTicker(5 * time.Millisecond)
+	defer ticker.Stop()
+	for p.Tasks() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (p *WorkerPool) track(task func()) func() {
+	return func() {
+		atomic.AddInt64(&p.queued, -1)
+		defer atomic.AddInt64(&p.tasks, -1)
+		task()
+	}
+}
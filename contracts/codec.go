@@ -0,0 +1,319 @@
+package contracts
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// WireFormat selects how RPC messages are encoded on a connection.
+type WireFormat int
+
+const (
+	// Legacy is the original format: PascalCase fields and integer ids,
+	// with id 0 marking notifications.
+	Legacy WireFormat = iota
+	// JsonRpc2 follows the JSON-RPC 2.0 specification.
+	JsonRpc2
+)
+
+// Websocket subprotocols a client can ask for to select a wire format.
+const (
+	LegacySubprotocol   = "client-connector"
+	JsonRpc2Subprotocol = "jsonrpc-2.0"
+)
+
+// Version is the value of the "jsonrpc" member in JSON-RPC 2.0 messages.
+const Version = "2.0"
+
+// WireFormats lists all supported formats.
+var WireFormats = []WireFormat{Legacy, JsonRpc2}
+
+func (f WireFormat) String() string {
+	switch f {
+	case Legacy:
+		return "legacy"
+	case JsonRpc2:
+		return "jsonrpc2"
+	}
+	return fmt.Sprintf("WireFormat(%d)", int(f))
+}
+
+// Subprotocol returns the websocket subprotocol which selects the format.
+func (f WireFormat) Subprotocol() string {
+	if f == JsonRpc2 {
+		return JsonRpc2Subprotocol
+	}
+	return LegacySubprotocol
+}
+
+// ParseWireFormat parses the name returned by WireFormat.String.
+func ParseWireFormat(s string) (WireFormat, error) {
+	for _, f := range WireFormats {
+		if f.String() == s {
+			return f, nil
+		}
+	}
+	return Legacy, fmt.Errorf("unknown wire format '%s'", s)
+}
+
+// WireFormatForSubprotocol returns the format selected by a websocket
+// subprotocol.
+func WireFormatForSubprotocol(p string) (WireFormat, bool) {
+	for _, f := range WireFormats {
+		if f.Subprotocol() == p {
+			return f, true
+		}
+	}
+	return Legacy, false
+}
+
+// RpcMessage is one decoded inbound message. Exactly one of the fields is
+// set: Error means the message was invalid and Error should be sent back,
+// with ErrorId as the id.
+type RpcMessage struct {
+	Request  *RpcRequest
+	Response *RpcResponse
+	Error    *RpcError
+	ErrorId  RpcId
+}
+
+//-------------------------------------------------
+
+// EncodeRequest encodes a request or a notification.
+func (f WireFormat) EncodeRequest(req *RpcRequest) ([]byte, error) {
+	if f == JsonRpc2 {
+		m := jsonRpc2Request{JsonRpc: Version, Method: req.Method, Params: req.Params}
+		if !req.ID.IsAbsent() {
+			m.ID = &req.ID
+		}
+		return json.Marshal(m)
+	}
+	id, err := legacyId(req.ID)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(legacyRequest{ID: id, Method: req.Method, Params: req.Params})
+}
+
+// EncodeResponse encodes a single response.
+func (f WireFormat) EncodeResponse(res *RpcResponse) ([]byte, error) {
+	return json.Marshal(f.response(res))
+}
+
+// EncodeBatch encodes responses to a batch request. Only JsonRpc2 supports
+// batches.
+func (f WireFormat) EncodeBatch(res []*RpcResponse) ([]byte, error) {
+	if f != JsonRpc2 {
+		return nil, fmt.Errorf("%s format does not support batches", f)
+	}
+	batch := make([]interface{}, len(res))
+	for i, r := range res {
+		batch[i] = f.response(r)
+	}
+	return json.Marshal(batch)
+}
+
+func (f WireFormat) response(res *RpcResponse) interface{} {
+	if f == JsonRpc2 {
+		id := res.ID
+		if id.IsAbsent() {
+			id = NullId
+		}
+		if res.Error != nil {
+			return jsonRpc2Failure{
+				JsonRpc: Version,
+				Error:   jsonRpc2Error{res.Error.Code, res.Error.Message, res.Error.Data},
+				ID:      id,
+			}
+		}
+		return jsonRpc2Success{JsonRpc: Version, Result: res.Result, ID: id}
+	}
+	m := legacyResponse{Result: res.Result}
+	m.ID, _ = legacyId(res.ID)
+	if res.Error != nil {
+		m.Error = *res.Error
+	}
+	return m
+}
+
+//-------------------------------------------------
+
+// Decode decodes a text frame payload. batch reports whether the payload was
+// a JSON-RPC 2.0 batch, in which case replies must be sent as a batch too.
+// Malformed messages are reported as RpcMessage with Error set.
+func (f WireFormat) Decode(data []byte) (msgs []RpcMessage, batch bool) {
+	data = bytes.TrimSpace(data)
+	if f == JsonRpc2 && len(data) > 0 && data[0] == '[' {
+		var raw []json.RawMessage
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return []RpcMessage{parseError(err)}, false
+		}
+		if len(raw) == 0 {
+			return []RpcMessage{invalidRequest(NullId, "empty batch")}, false
+		}
+		msgs = make([]RpcMessage, len(raw))
+		for i, r := range raw {
+			msgs[i] = decodeJsonRpc2(r)
+		}
+		return msgs, true
+	}
+	if !json.Valid(data) {
+		return []RpcMessage{parseError(fmt.Errorf("invalid json"))}, false
+	}
+	if f == JsonRpc2 {
+		return []RpcMessage{decodeJsonRpc2(data)}, false
+	}
+	return []RpcMessage{decodeLegacy(data)}, false
+}
+
+func decodeJsonRpc2(data []byte) RpcMessage {
+	var m struct {
+		JsonRpc *string         `json:"jsonrpc"`
+		Method  *string         `json:"method"`
+		Params  json.RawMessage `json:"params"`
+		ID      json.RawMessage `json:"id"`
+		Result  json.RawMessage `json:"result"`
+		Error   *jsonRpc2Error  `json:"error"`
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return invalidRequest(NullId, err.Error())
+	}
+
+	var id RpcId
+	if m.ID != nil {
+		if err := id.UnmarshalJSON(m.ID); err != nil {
+			return invalidRequest(NullId, err.Error())
+		}
+	}
+	if m.JsonRpc == nil || *m.JsonRpc != Version {
+		return invalidRequest(errorId(id), `"jsonrpc" must be "2.0"`)
+	}
+
+	if m.Method == nil {
+		// A response to one of our requests.
+		if id.IsAbsent() {
+			return invalidRequest(NullId, "response without id")
+		}
+		if (m.Result != nil) == (m.Error != nil) {
+			return invalidRequest(id, "response must have either result or error")
+		}
+		res := &RpcResponse{ID: id}
+		if m.Error != nil {
+			res.Error = &RpcError{Code: m.Error.Code, Message: m.Error.Message, Data: m.Error.Data}
+		} else if err := json.Unmarshal(m.Result, &res.Result); err != nil {
+			return invalidRequest(id, err.Error())
+		}
+		return RpcMessage{Response: res}
+	}
+
+	req := &RpcRequest{ID: id, Method: *m.Method}
+	if len(m.Params) > 0 && string(m.Params) != "null" {
+		switch m.Params[0] {
+		case '{':
+			if err := json.Unmarshal(m.Params, &req.Params); err != nil {
+				return invalidRequest(errorId(id), err.Error())
+			}
+		case '[':
+			return RpcMessage{
+				Error:   NewRpcError(InvalidParams, "params must be passed by name"),
+				ErrorId: errorId(id),
+			}
+		default:
+			return invalidRequest(errorId(id), "params must be an object")
+		}
+	}
+	return RpcMessage{Request: req}
+}
+
+func decodeLegacy(data []byte) RpcMessage {
+	var m struct {
+		ID     int         `json:"Id"`
+		Method string      `json:"Method"`
+		Params RpcParams   `json:"Params"`
+		Result interface{} `json:"Result"`
+		Error  *RpcError   `json:"Error"`
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return invalidRequest(NullId, err.Error())
+	}
+	var id RpcId
+	if m.ID != 0 {
+		id = IntId(m.ID)
+	}
+	if m.Method != "" {
+		return RpcMessage{Request: &RpcRequest{ID: id, Method: m.Method, Params: m.Params}}
+	}
+	res := &RpcResponse{ID: id, Result: m.Result}
+	if m.Error != nil && m.Error.Code != 0 {
+		res.Error = m.Error
+	}
+	return RpcMessage{Response: res}
+}
+
+func parseError(err error) RpcMessage {
+	return RpcMessage{Error: NewRpcError(ParserError, err.Error()), ErrorId: NullId}
+}
+
+func invalidRequest(id RpcId, reason string) RpcMessage {
+	return RpcMessage{Error: NewRpcError(InvalidRequest, reason), ErrorId: id}
+}
+
+// errorId returns the id to answer an invalid request with. Notifications
+// are answered with a null id, as their id is unknown.
+func errorId(id RpcId) RpcId {
+	if id.IsAbsent() {
+		return NullId
+	}
+	return id
+}
+
+func legacyId(id RpcId) (int, error) {
+	if id.IsAbsent() || id.IsNull() {
+		return 0, nil
+	}
+	n, ok := id.Int()
+	if !ok {
+		return 0, fmt.Errorf("legacy format supports integer ids only, got %s", id)
+	}
+	return n, nil
+}
+
+//-------------------------------------------------
+
+type legacyRequest struct {
+	ID     int       `json:"Id"`
+	Method string    `json:"Method"`
+	Params RpcParams `json:"Params"`
+}
+
+type legacyResponse struct {
+	ID     int         `json:"Id"`
+	Result interface{} `json:"Result"`
+	Error  RpcError    `json:"Error"`
+}
+
+type jsonRpc2Request struct {
+	JsonRpc string    `json:"jsonrpc"`
+	Method  string    `json:"method"`
+	Params  RpcParams `json:"params,omitempty"`
+	ID      *RpcId    `json:"id,omitempty"`
+}
+
+type jsonRpc2Success struct {
+	JsonRpc string      `json:"jsonrpc"`
+	Result  interface{} `json:"result"`
+	ID      RpcId       `json:"id"`
+}
+
+type jsonRpc2Failure struct {
+	JsonRpc string        `json:"jsonrpc"`
+	Error   jsonRpc2Error `json:"error"`
+	ID      RpcId         `json:"id"`
+}
+
+type jsonRpc2Error struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
@@ -0,0 +1,127 @@
+package contracts
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestJsonRpc2EncodeRequest(t *testing.T) {
+	tests := []struct {
+		req  RpcRequest
+		want string
+	}{
+		{RpcRequest{ID: IntId(7), Method: "Ping"}, `{"jsonrpc":"2.0","method":"Ping","id":7}`},
+		{RpcRequest{ID: StringId("a"), Method: "Ping", Params: RpcParams{"x": 1}}, `{"jsonrpc":"2.0","method":"Ping","params":{"x":1},"id":"a"}`},
+		{RpcRequest{Method: "goodbye"}, `{"jsonrpc":"2.0","method":"goodbye"}`},
+	}
+	for _, test := range tests {
+		got, err := JsonRpc2.EncodeRequest(&test.req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != test.want {
+			t.Errorf("EncodeRequest(%+v) = %s; want %s", test.req, got, test.want)
+		}
+	}
+}
+
+func TestJsonRpc2EncodeResponse(t *testing.T) {
+	tests := []struct {
+		res  RpcResponse
+		want string
+	}{
+		{RpcResponse{ID: IntId(1)}, `{"jsonrpc":"2.0","result":null,"id":1}`},
+		{RpcResponse{ID: StringId("x"), Error: NewRpcError(MethodNotFound, "nope")}, `{"jsonrpc":"2.0","error":{"code":-32601,"message":"nope"},"id":"x"}`},
+		{RpcResponse{Error: NewRpcError(ParserError, "bad")}, `{"jsonrpc":"2.0","error":{"code":-32700,"message":"bad"},"id":null}`},
+	}
+	for _, test := range tests {
+		got, err := JsonRpc2.EncodeResponse(&test.res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != test.want {
+			t.Errorf("EncodeResponse(%+v) = %s; want %s", test.res, got, test.want)
+		}
+	}
+}
+
+func TestLegacyEncodeIsUnchanged(t *testing.T) {
+	got, err := Legacy.EncodeRequest(&RpcRequest{Method: "goodbye"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"Id":0,"Method":"goodbye","Params":null}`; string(got) != want {
+		t.Errorf("EncodeRequest = %s; want %s", got, want)
+	}
+	got, err = Legacy.EncodeResponse(&RpcResponse{ID: IntId(3), Result: "ok"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"Id":3,"Result":"ok","Error":{"Code":0,"Message":"","Data":null}}`; string(got) != want {
+		t.Errorf("EncodeResponse = %s; want %s", got, want)
+	}
+}
+
+func TestJsonRpc2Decode(t *testing.T) {
+	tests := []struct {
+		in    string
+		batch bool
+		want  []RpcMessage
+	}{
+		{
+			in:   `{"jsonrpc":"2.0","method":"greet","params":{"name":"bob"},"id":"q"}`,
+			want: []RpcMessage{{Request: &RpcRequest{ID: StringId("q"), Method: "greet", Params: RpcParams{"name": "bob"}}}},
+		},
+		{
+			in:   `{"jsonrpc":"2.0","method":"note"}`,
+			want: []RpcMessage{{Request: &RpcRequest{Method: "note"}}},
+		},
+		{
+			in:   `{"jsonrpc":"2.0","result":null,"id":4}`,
+			want: []RpcMessage{{Response: &RpcResponse{ID: IntId(4)}}},
+		},
+		{
+			in:   `{"jsonrpc":"2.0","method":"sum","params":[1,2],"id":1}`,
+			want: []RpcMessage{{Error: NewRpcError(InvalidParams, ""), ErrorId: IntId(1)}},
+		},
+		{
+			in:   `{"jsonrpc":"2.0","result":1,"error":{"code":1,"message":""},"id":4}`,
+			want: []RpcMessage{{Error: NewRpcError(InvalidRequest, ""), ErrorId: IntId(4)}},
+		},
+		{
+			in:   `{"method":"sum","id":1}`,
+			want: []RpcMessage{{Error: NewRpcError(InvalidRequest, ""), ErrorId: IntId(1)}},
+		},
+		{
+			in:   `{"jsonrpc":"2.0","method":1,"id":1`,
+			want: []RpcMessage{{Error: NewRpcError(ParserError, ""), ErrorId: NullId}},
+		},
+		{
+			in:   `[]`,
+			want: []RpcMessage{{Error: NewRpcError(InvalidRequest, ""), ErrorId: NullId}},
+		},
+		{
+			in:    `[{"jsonrpc":"2.0","method":"a","id":1}, 1]`,
+			batch: true,
+			want: []RpcMessage{
+				{Request: &RpcRequest{ID: IntId(1), Method: "a"}},
+				{Error: NewRpcError(InvalidRequest, ""), ErrorId: NullId},
+			},
+		},
+	}
+	for _, test := range tests {
+		got, batch := JsonRpc2.Decode([]byte(test.in))
+		if batch != test.batch {
+			t.Errorf("Decode(%s) batch = %v; want %v", test.in, batch, test.batch)
+		}
+		for i := range got {
+			// Compare error codes only.
+			if got[i].Error != nil {
+				got[i].Error = NewRpcError(got[i].Error.Code, "")
+			}
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Decode(%s) = %+v; want %+v", test.in, got, test.want)
+		}
+	}
+}
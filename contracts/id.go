@@ -0,0 +1,84 @@
+package contracts
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+)
+
+// RpcId is a request id: a string, a number or null.
+// The zero value is an absent id, which marks a notification.
+type RpcId struct {
+	raw string // JSON encoding of the id, empty when absent.
+}
+
+// NullId is the explicit null id, used to answer requests whose id could not
+// be determined.
+var NullId = RpcId{raw: "null"}
+
+var errBadId = errors.New("id must be a string, a number or null")
+
+// IntId returns a numeric id.
+func IntId(n int) RpcId {
+	return RpcId{raw: strconv.Itoa(n)}
+}
+
+// StringId returns a string id.
+func StringId(s string) RpcId {
+	b, _ := json.Marshal(s)
+	return RpcId{raw: string(b)}
+}
+
+// IsAbsent reports whether the id is missing, i.e. the request is a
+// notification.
+func (id RpcId) IsAbsent() bool {
+	return id.raw == ""
+}
+
+// IsNull reports whether the id is an explicit null.
+func (id RpcId) IsNull() bool {
+	return id.raw == "null"
+}
+
+// Int returns the id as an integer, if it is one.
+func (id RpcId) Int() (int, bool) {
+	n, err := strconv.Atoi(id.raw)
+	return n, err == nil
+}
+
+// String returns the JSON form of the id, for logging.
+func (id RpcId) String() string {
+	return id.raw
+}
+
+// MarshalJSON implements json.Marshaler. An absent id is encoded as null.
+func (id RpcId) MarshalJSON() ([]byte, error) {
+	if id.raw == "" {
+		return []byte("null"), nil
+	}
+	return []byte(id.raw), nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (id *RpcId) UnmarshalJSON(b []byte) error {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return errBadId
+	}
+	switch {
+	case string(b) == "null":
+	case b[0] == '"':
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+	default:
+		var n json.Number
+		if err := json.Unmarshal(b, &n); err != nil {
+			return errBadId
+		}
+	}
+	id.raw = string(b)
+	return nil
+}
@@ -5,16 +5,23 @@ package contracts
 // performance.
 type RpcParams map[string]interface{}
 
+// RpcRequest is a request or, when ID is absent, a notification.
 type RpcRequest struct {
-	ID     int       `json:"Id"`
+	ID     RpcId     `json:"Id"`
 	Method string    `json:"Method"`
 	Params RpcParams `json:"Params"`
 }
 
+// TraceParam is the parameter carrying the W3C trace context of a request
+// sent to a client, an object with a "traceparent" and an optional
+// "tracestate" member, so the client can continue the trace.
+const TraceParam = "TraceContext"
+
+// RpcResponse carries either Result or, when the call failed, Error.
 type RpcResponse struct {
-	ID     int         `json:"Id"`
+	ID     RpcId       `json:"Id"`
 	Result interface{} `json:"Result"`
-	Error  RpcError    `json:"Error"`
+	Error  *RpcError   `json:"Error"`
 }
 
 type RpcError struct {
@@ -23,6 +30,16 @@ type RpcError struct {
 	Data    interface{} `json:"Data"`
 }
 
+// NewRpcError returns an RpcError with the given code and message.
+func NewRpcError(code int, message string) *RpcError {
+	return &RpcError{Code: code, Message: message}
+}
+
+// Error implements the error interface, so an RpcError can be returned as is.
+func (e *RpcError) Error() string {
+	return e.Message
+}
+
 const (
 	/// <summary>Invalid JSON was received by the server. An error occurred on the server while parsing the JSON text.</summary>
 	ParserError = -32700
@@ -37,3 +54,13 @@ const (
 	/// <summary>Reserved for implementation-defined server-errors.</summary>
 	ServerError = -32000
 )
+
+// String returns the string parameter name. A missing or non-string
+// parameter is reported as an InvalidParams *RpcError.
+func (p RpcParams) String(name string) (string, error) {
+	v, ok := p[name].(string)
+	if !ok {
+		return "", NewRpcError(InvalidParams, "missing string parameter '"+name+"'")
+	}
+	return v, nil
+}
@@ -0,0 +1,196 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/spoconnor/Go-Client-Connector/config"
+)
+
+// DefaultConfigPath is where the logger config is read from.
+const DefaultConfigPath = "config/logger/logger.json"
+
+// Defaults of the logger config.
+const (
+	DefaultLevel        = "info"
+	DefaultFormat       = "json"
+	DefaultPayloadLimit = 512
+)
+
+// DefaultRedact lists the payload fields redacted when the config names none.
+var DefaultRedact = []string{"password", "secret", "token", "proof", "authorization"}
+
+// Redacted replaces the values of redacted payload fields.
+const Redacted = "[REDACTED]"
+
+// Attribute keys of connection loggers.
+const (
+	KeyAttr          = "key"
+	ConnectionIdAttr = "connection_id"
+	RemoteAddrAttr   = "remote_addr"
+)
+
+var (
+	level  = new(slog.LevelVar)
+	policy atomic.Value // *payloadPolicy
+)
+
+func init() {
+	policy.Store(&payloadPolicy{})
+}
+
+// LoadConfig reads the logger config at path. Missing fields, or a missing
+// file, leave the defaults.
+func LoadConfig(path string) (config.LoggerConfig, error) {
+	cfg := config.LoggerConfig{
+		Level:        DefaultLevel,
+		Format:       DefaultFormat,
+		Stderr:       true,
+		PayloadLimit: DefaultPayloadLimit,
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("%s: %s", path, err)
+	}
+	return cfg, nil
+}
+
+// Setup makes a logger configured by cfg the default of slog and of the log
+// package, whose messages are logged at info level. It returns the log file,
+// to be closed on exit.
+func Setup(cfg config.LoggerConfig) (io.Closer, error) {
+	if err := SetLevel(cfg.Level); err != nil {
+		return nil, err
+	}
+	var (
+		writers []io.Writer
+		file    io.Closer = ioutil.NopCloser(nil)
+	)
+	if cfg.File != "" {
+		f, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("open log file %s failed: %v", cfg.File, err)
+		}
+		writers = append(writers, f)
+		file = f
+	}
+	if cfg.Stderr || len(writers) == 0 {
+		writers = append(writers, os.Stderr)
+	}
+	out := io.MultiWriter(writers...)
+
+	opts := &slog.HandlerOptions{Level: level, AddSource: cfg.Source}
+	var h slog.Handler
+	switch cfg.Format {
+	case "json":
+		h = slog.NewJSONHandler(out, opts)
+	case "text":
+		h = slog.NewTextHandler(out, opts)
+	default:
+		file.Close()
+		return nil, fmt.Errorf("unknown log format '%s'", cfg.Format)
+	}
+	log.SetFlags(0) // slog adds the time
+	slog.SetDefault(slog.New(h))
+	SetPayloads(cfg.Payloads, cfg.PayloadLimit, cfg.Redact)
+	return file, nil
+}
+
+// SetLevel changes the level of the default logger, which may be in use.
+func SetLevel(name string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(name)); err != nil {
+		return err
+	}
+	level.Set(l)
+	return nil
+}
+
+// SetPayloads enables or disables payload logging, which may be in use.
+// Payloads are cut after limit bytes and the values of fields named in
+// redact, at any depth and in any case, are replaced with Redacted.
+func SetPayloads(enabled bool, limit int, redact []string) {
+	if limit <= 0 {
+		limit = DefaultPayloadLimit
+	}
+	if len(redact) == 0 {
+		redact = DefaultRedact
+	}
+	p := &payloadPolicy{enabled: enabled, limit: limit, redact: make(map[string]bool, len(redact))}
+	for _, name := range redact {
+		p.redact[strings.ToLower(name)] = true
+	}
+	policy.Store(p)
+}
+
+// Message logs msg with args at debug level, adding payload when payload
+// logging is enabled.
+func Message(l *slog.Logger, msg string, payload interface{}, args ...interface{}) {
+	if !l.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	if p := policy.Load().(*payloadPolicy); p.enabled {
+		args = append(args, "payload", p.format(payload))
+	}
+	l.Debug(msg, args...)
+}
+
+// payloadPolicy tells whether and how payloads are logged.
+type payloadPolicy struct {
+	enabled bool
+	limit   int
+	redact  map[string]bool // lower case field names
+}
+
+// format returns payload as json with redacted fields, cut to the limit.
+func (p *payloadPolicy) format(payload interface{}) string {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Sprintf("unloggable payload: %s", err)
+	}
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(&v); err == nil {
+		if data, err = json.Marshal(p.redacted(v)); err != nil {
+			return fmt.Sprintf("unloggable payload: %s", err)
+		}
+	}
+	if len(data) > p.limit {
+		return string(data[:p.limit]) + "..."
+	}
+	return string(data)
+}
+
+func (p *payloadPolicy) redacted(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, field := range v {
+			if p.redact[strings.ToLower(k)] {
+				v[k] = Redacted
+			} else {
+				v[k] = p.redacted(field)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = p.redacted(item)
+		}
+	}
+	return v
+}
@@ -0,0 +1,73 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	cfg, err := LoadConfig("../" + DefaultConfigPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Level != "info" || cfg.Format != "json" || cfg.Payloads {
+		t.Errorf("config = %+v", cfg)
+	}
+
+	cfg, err = LoadConfig("missing.json")
+	if err != nil || cfg.Level != DefaultLevel || !cfg.Stderr {
+		t.Errorf("defaults = %+v, %v", cfg, err)
+	}
+}
+
+func TestMessage(t *testing.T) {
+	var buf bytes.Buffer
+	l := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: level}))
+	defer SetPayloads(false, 0, nil)
+	defer SetLevel(DefaultLevel)
+
+	payload := map[string]interface{}{
+		"name":  "x",
+		"Token": "t0p",
+		"inner": []interface{}{map[string]interface{}{"password": "pw", "n": 1}},
+	}
+
+	SetLevel("info")
+	SetPayloads(true, 0, nil)
+	Message(l, "hidden", payload)
+	if buf.Len() != 0 {
+		t.Fatalf("logged above level: %s", buf.String())
+	}
+
+	SetLevel("debug")
+	SetPayloads(false, 0, nil)
+	Message(l, "plain", payload, "method", "m")
+	if strings.Contains(buf.String(), "payload") {
+		t.Errorf("payload logged while disabled: %s", buf.String())
+	}
+
+	buf.Reset()
+	SetPayloads(true, 0, nil)
+	Message(l, "full", payload)
+	var line struct{ Payload string }
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(line.Payload, "t0p") || strings.Contains(line.Payload, "pw") {
+		t.Errorf("payload not redacted: %s", line.Payload)
+	}
+	if !strings.Contains(line.Payload, `"name":"x"`) || strings.Count(line.Payload, Redacted) != 2 {
+		t.Errorf("payload = %s", line.Payload)
+	}
+
+	buf.Reset()
+	SetPayloads(true, 8, []string{"name"})
+	Message(l, "cut", payload)
+	json.Unmarshal(buf.Bytes(), &line)
+	if line.Payload != `{"Token"...` {
+		t.Errorf("cut payload = %s", line.Payload)
+	}
+}
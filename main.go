@@ -9,38 +9,301 @@
 package main
 
 import (
-	"bufio"
+	"context"
 	"flag"
+	"fmt"
 	"log"
+	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 	//	_ "net/http/pprof"  // TODO
+	"github.com/spoconnor/Go-Client-Connector/auth"
+	"github.com/spoconnor/Go-Client-Connector/cluster"
+	"github.com/spoconnor/Go-Client-Connector/config"
+	"github.com/spoconnor/Go-Client-Connector/connections"
+	"github.com/spoconnor/Go-Client-Connector/contracts"
+	"github.com/spoconnor/Go-Client-Connector/logging"
+	"github.com/spoconnor/Go-Client-Connector/metrics"
+	"github.com/spoconnor/Go-Client-Connector/registry"
 	"github.com/spoconnor/Go-Client-Connector/servers"
-	logging "github.com/spoconnor/Go-Common-Code/logging"
+	"github.com/spoconnor/Go-Client-Connector/store"
+	"github.com/spoconnor/Go-Client-Connector/tracing"
+	"github.com/spoconnor/Go-Client-Connector/webhook"
 )
 
-var (
-	addr = flag.String("listen", ":8080", "address to bind to")
-	//debug     = flag.String("pprof", "", "address for pprof http")
-	workers   = flag.Int("workers", 128, "max workers count")
-	queue     = flag.Int("queue", 1, "workers task queue size")
-	ioTimeout = flag.Duration("io_timeout", time.Millisecond*100, "i/o operations timeout")
-)
+var configFile = flag.String("config", "config/connector.yaml", "yaml or json file configuring the connector; CONNECTOR_* environment variables override it")
 
-func main() {
-	logging.SetupLog("client-connector", "info", "output.txt", true)
-	log.Println("Starting client-connector")
+// defaults returns the config used for settings the config file and the
+// environment leave unset.
+func defaults() *config.Config {
+	return &config.Config{
+		Node: hostname(),
+		WebSocket: config.WebSocketConfig{
+			Listen:     ":8080",
+			IOTimeout:  100 * time.Millisecond,
+			WireFormat: contracts.Legacy.String(),
+		},
+		Rest: config.RestConfig{
+			Listen:      ":9000",
+			Prefix:      servers.DefaultPrefix,
+			EventBuffer: servers.DefaultEventBuffer,
+		},
+		Pool: config.PoolConfig{Workers: 128, Queue: 1},
+		Clients: config.ClientsConfig{
+			CallTimeout:       connections.DefaultCallTimeout,
+			DuplicateKeys:     connections.EvictExisting.String(),
+			HeartbeatInterval: 30 * time.Second,
+			HeartbeatMisses:   3,
+			OfflineDepth:      100,
+			TopicHistory:      connections.DefaultTopicHistory,
+			RetainedTopics:    connections.DefaultRetainedTopics,
+		},
+		Limits: config.LimitsConfig{Action: connections.ReplyError.String(), MaxMessageSize: connections.DefaultMaxMessageSize},
+		Auth:   config.AuthConfig{JwtAlg: "HS256", JwtQueryParam: "access_token"},
+		Store:  config.StoreConfig{Backend: store.MemoryBackend, Path: "client-connector.db", DeadLetters: store.DefaultDeadLetterLimit},
+		Services: config.ServicesConfig{
+			Region:        "us-east-1",
+			RegistryTable: registry.DefaultTable,
+		},
+		Cluster:         config.ClusterConfig{SyncInterval: cluster.DefaultSyncInterval},
+		Webhooks:        config.WebhookConfig{Attempts: webhook.DefaultMaxAttempts, Backoff: webhook.DefaultBackoff},
+		LogConfig:       logging.DefaultConfigPath,
+		ShutdownTimeout: 30 * time.Second,
+	}
+}
 
+func main() {
 	flag.Parse()
 
-	ws := servers.NetWebSocketServer(*addr, *ioTimeout, *workers, *queue)
-	go ws.Start()
+	// Until the logger is set up, errors go to the standard logger.
+	cfg := defaults()
+	if err := config.Load(*configFile, cfg); err != nil {
+		log.Fatalf("loading config: %v", err)
+	}
+
+	logConfig, err := logging.LoadConfig(cfg.LogConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logOutput, err := logging.Setup(logConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer logOutput.Close()
+	slog.Info("Starting client-connector", "config", *configFile, "node", cfg.Node)
+
+	// Validate checked the format already.
+	format, _ := contracts.ParseWireFormat(cfg.WebSocket.WireFormat)
+
+	duplicateKeys, err := connections.ParseDuplicateKeyPolicy(cfg.Clients.DuplicateKeys)
+	if err != nil {
+		fatal("Invalid clients.duplicate_keys", err)
+	}
+
+	limits, err := rateLimits(cfg.Limits)
+	if err != nil {
+		fatal("Invalid limits", err)
+	}
+
+	var stopTracing func(context.Context) error
+	if cfg.TraceEndpoint != "" {
+		stopTracing, err = tracing.Setup(cfg.TraceEndpoint)
+		if err != nil {
+			fatal("Invalid trace_endpoint", err)
+		}
+	}
+
+	ws := servers.NetWebSocketServer(cfg.WebSocket.Listen, cfg.WebSocket.IOTimeout, cfg.Pool.Workers, cfg.Pool.Queue)
+	ws.ConnectionsManager.CallTimeout = cfg.Clients.CallTimeout
+	ws.ConnectionsManager.DuplicateKeys = duplicateKeys
+	ws.ConnectionsManager.TopicHistory = cfg.Clients.TopicHistory
+	ws.ConnectionsManager.RetainedTopics = cfg.Clients.RetainedTopics
+	ws.ConnectionsManager.ResumeGrace = cfg.Clients.ResumeGrace
+	ws.ConnectionsManager.SetRateLimits(limits)
+	st, err := store.Open(cfg.Store)
+	if err != nil {
+		fatal("Opening store failed", err)
+	}
+	defer st.Close()
+	ws.ConnectionsManager.Store = st
+	ws.ConnectionsManager.DeadLetterLimit = cfg.Store.DeadLetters
+	var dynamo *registry.DynamoRegistry
+	if cfg.Services.DynamoDb != "" {
+		dynamo, err = registry.NewDynamoRegistry(cfg.Services, cfg.Node)
+		if err != nil {
+			fatal("Connecting to dynamodb failed", err)
+		}
+		ws.ConnectionsManager.Registry = dynamo
+	}
+	if cfg.Clients.OfflineTTL > 0 {
+		ws.ConnectionsManager.Offline = connections.NewOfflineQueue(st, cfg.Clients.OfflineTTL, cfg.Clients.OfflineDepth)
+		ws.ConnectionsManager.Offline.DeadLetterLimit = cfg.Store.DeadLetters
+	}
+	var hooks *webhook.Sender
+	if len(cfg.Webhooks.URLs) > 0 {
+		hooks = webhook.New(cfg.Webhooks.URLs, []byte(cfg.Webhooks.Secret), st)
+		hooks.MaxAttempts = cfg.Webhooks.Attempts
+		hooks.Backoff = cfg.Webhooks.Backoff
+		hooks.DeadLetterLimit = cfg.Store.DeadLetters
+		hooks.Start(webhook.DefaultWorkers)
+		ws.ConnectionsManager.OnEvent(hooks.Send)
+	}
+	ws.WireFormat = format
+
+	if cfg.Auth.KeySecrets != "" {
+		secrets, err := connections.LoadKeySecretStore(cfg.Auth.KeySecrets)
+		if err != nil {
+			fatal("Loading key secrets failed", err)
+		}
+		ws.ConnectionsManager.Secrets = secrets
+	} else {
+		slog.Warn("No key secrets configured, all key handshakes will be refused")
+	}
+
+	if cfg.Auth.JwtKey != "" {
+		tokens, err := auth.NewTokenValidator(cfg.Auth.JwtAlg, cfg.Auth.JwtKey)
+		if err != nil {
+			fatal("Loading token key failed", err)
+		}
+		ws.Tokens = tokens
+		ws.TokenQueryParam = cfg.Auth.JwtQueryParam
+	}
+	rs := servers.NewRestServer(ws.ConnectionsManager, cfg.Rest.Listen)
+	rs.Prefix = cfg.Rest.Prefix
+	rs.Events = servers.NewEventStream(cfg.Rest.EventBuffer)
+	ws.ConnectionsManager.OnEvent(rs.Events.Publish)
+	registerGauges(ws.ConnectionsManager)
 
-	rs := servers.NewRestServer(ws.ConnectionsManager)
+	reload := &reloader{path: *configFile, cfg: cfg, conns: ws.ConnectionsManager, hooks: hooks}
+	if cfg.TLS.Cert != "" {
+		cert, err := servers.LoadCertificate(cfg.TLS.Cert, cfg.TLS.Key)
+		if err != nil {
+			fatal("Loading tls certificate failed", err)
+		}
+		ws.TLS = cert.TLSConfig()
+		rs.TLS = cert.TLSConfig()
+		if cfg.Rest.ClientCA != "" {
+			if err := servers.RequireClientCertificates(rs.TLS, cfg.Rest.ClientCA); err != nil {
+				fatal("Loading rest client ca failed", err)
+			}
+		}
+		// Reloaded on SIGHUP, e.g. after it was renewed.
+		reload.cert = cert
+	}
+
+	var cl *cluster.Cluster
+	if cfg.Cluster.Peers != "" {
+		list, err := cluster.ParsePeers(cfg.Cluster.Peers)
+		if err != nil {
+			fatal("Invalid cluster.peers", err)
+		}
+		cl = cluster.New(cfg.Node, list, cfg.Cluster.Secret)
+		cl.SyncInterval = cfg.Cluster.SyncInterval
+		cl.Prefix = cfg.Rest.Prefix
+		// Peers may require the certificate of this node, or be signed by
+		// the CA of the rest clients.
+		ca := cfg.Cluster.CA
+		if ca == "" {
+			ca = cfg.Rest.ClientCA
+		}
+		if reload.cert != nil || ca != "" {
+			tlsConfig, err := servers.ClientTLSConfig(reload.cert, ca)
+			if err != nil {
+				fatal("Loading cluster ca failed", err)
+			}
+			cl.SetTLS(tlsConfig)
+		}
+		ws.ConnectionsManager.Cluster = cl
+		rs.Cluster = cl
+	}
+	reload.watch()
+
+	ws.ConnectionsManager.StartHeartbeat(cfg.Clients.HeartbeatInterval, cfg.Clients.HeartbeatMisses)
+	go ws.Start()
 	go rs.Start()
+	if cl != nil {
+		cl.Start(ws.ConnectionsManager.Keys)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	slog.Info("Shutting down", "signal", (<-stop).String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := ws.Shutdown(ctx); err != nil {
+		slog.Error("Shutdown failed", "component", "websocket", "err", err)
+	}
+	if err := rs.Shutdown(ctx); err != nil {
+		slog.Error("Shutdown failed", "component", "rest", "err", err)
+	}
+	if cl != nil {
+		cl.Stop()
+	}
+	if hooks != nil {
+		if err := hooks.Close(ctx); err != nil {
+			slog.Error("Shutdown failed", "component", "webhooks", "err", err)
+		}
+	}
+	if dynamo != nil {
+		if err := dynamo.Close(ctx); err != nil {
+			slog.Error("Shutdown failed", "component", "registry", "err", err)
+		}
+	}
+	if stopTracing != nil {
+		if err := stopTracing(ctx); err != nil {
+			slog.Error("Shutdown failed", "component", "tracing", "err", err)
+		}
+	}
+	slog.Info("Done")
+}
+
+// fatal logs that the connector cannot start and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+// rateLimits returns the connection rate limits configured by cfg.
+func rateLimits(cfg config.LimitsConfig) (connections.RateLimits, error) {
+	action, err := connections.ParseRateLimitAction(cfg.Action)
+	if err != nil {
+		return connections.RateLimits{}, fmt.Errorf("limits.action: %v", err)
+	}
+	return connections.RateLimits{
+		Messages:       cfg.Messages,
+		MessageBurst:   cfg.MessageBurst,
+		Bytes:          cfg.Bytes,
+		ByteBurst:      cfg.ByteBurst,
+		Action:         action,
+		MaxMessageSize: cfg.MaxMessageSize,
+	}, nil
+}
+
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "client-connector"
+	}
+	return name
+}
 
-	log.Println("Press any key to exit")
-	reader := bufio.NewReader(os.Stdin)
-	_, _, _ = reader.ReadRune()
-	log.Println("Done")
+// registerGauges exposes the connection and pool counts of c as metrics.
+func registerGauges(c *connections.ConnectionsManager) {
+	metrics.GaugeFunc("connected_clients", "Registered websocket connections.", func() float64 {
+		connected, _ := c.Counts()
+		return float64(connected)
+	})
+	metrics.GaugeFunc("pending_handshakes", "Connections which did not complete the key handshake.", func() float64 {
+		_, pending := c.Counts()
+		return float64(pending)
+	})
+	metrics.GaugeFunc("pool_tasks", "Scheduled pool tasks which have not finished.", func() float64 {
+		return float64(c.Pool().Tasks())
+	})
+	metrics.GaugeFunc("pool_queued_tasks", "Scheduled pool tasks waiting for a worker.", func() float64 {
+		return float64(c.Pool().Queued())
+	})
 }
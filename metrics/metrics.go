@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Namespace prefixes the names of all metrics.
+const Namespace = "connector"
+
+// Directions of frames.
+const (
+	In  = "in"
+	Out = "out"
+)
+
+var (
+	// Frames counts websocket frames by direction and opcode.
+	Frames = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "frames_total",
+		Help:      "Websocket frames by direction and opcode.",
+	}, []string{"direction", "opcode"})
+
+	// FrameBytes counts payload bytes of websocket frames by direction and
+	// opcode.
+	FrameBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "frame_bytes_total",
+		Help:      "Payload bytes of websocket frames by direction and opcode.",
+	}, []string{"direction", "opcode"})
+
+	// CallDuration observes SendToClient calls awaiting a reply, by method.
+	CallDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "send_to_client_duration_seconds",
+		Help:      "Duration of SendToClient calls awaiting a reply, by method.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 16),
+	}, []string{"method"})
+
+	// RpcTimeouts counts requests to clients which were not answered in
+	// time, by method.
+	RpcTimeouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "rpc_timeouts_total",
+		Help:      "Requests to clients not answered before the deadline, by method.",
+	}, []string{"method"})
+
+	// RpcErrors counts requests to clients which failed or were answered
+	// with an error, by method.
+	RpcErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "rpc_errors_total",
+		Help:      "Requests to clients which failed or were answered with an error, by method.",
+	}, []string{"method"})
+
+	// ScheduleRejections counts tasks the pool rejected because no worker
+	// became free in time.
+	ScheduleRejections = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "pool_schedule_rejections_total",
+		Help:      "Tasks rejected by ScheduleTimeout because no worker became free in time.",
+	})
+
+	// BroadcastFanout observes how long broadcasts take to be written to
+	// every connection.
+	BroadcastFanout = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "broadcast_fanout_duration_seconds",
+		Help:      "Time from a broadcast to its write to the last connection.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 16),
+	})
+
+	// RateLimited counts client messages which exceeded a rate limit of
+	// their connection, by limit and action taken.
+	RateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "rate_limited_messages_total",
+		Help:      "Client messages exceeding a connection rate limit, by limit and action.",
+	}, []string{"limit", "action"})
+
+	// AcceptCooldowns counts pauses of the accept loop.
+	AcceptCooldowns = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "accept_cooldowns_total",
+		Help:      "Pauses of the websocket accept loop after accept errors or a busy pool.",
+	})
+)
+
+// GaugeFunc registers a gauge whose value is read from f when scraped.
+func GaugeFunc(name, help string, f func() float64) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Name:      name,
+		Help:      help,
+	}, f)
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,25 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	GaugeFunc("test_gauge", "A gauge for the test.", func() float64 { return 42 })
+	Frames.WithLabelValues(In, "text").Add(3)
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(rec.Body)
+	for _, want := range []string{
+		"connector_test_gauge 42",
+		`connector_frames_total{direction="in",opcode="text"} 3`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics miss %q", want)
+		}
+	}
+}
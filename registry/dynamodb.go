@@ -0,0 +1,225 @@
+package registry
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+
+	"github.com/spoconnor/Go-Client-Connector/config"
+)
+
+// DefaultTable is the table used when the config names none.
+const DefaultTable = "ClientConnections"
+
+// requestTimeout bounds every DynamoDB request.
+const requestTimeout = 5 * time.Second
+
+// startupTimeout bounds creating the table and clearing entries of a
+// previous run, which scans the whole table.
+const startupTimeout = 2 * time.Minute
+
+// DynamoRegistry keeps the registry in a DynamoDB table with partition key
+// "Key" and sort key "ConnectionId". Updates are sent in order by a single
+// goroutine, so they do not slow down handshakes. While DynamoDB is too slow
+// to keep up, updates beyond the queue are dropped.
+type DynamoRegistry struct {
+	db    *dynamodb.DynamoDB
+	table string
+	node  string
+
+	mu     sync.Mutex // guards closed against sends on ops
+	closed bool
+	ops    chan func(ctx context.Context) error
+	done   chan struct{}
+}
+
+// NewDynamoRegistry connects to the DynamoDB at cfg.DynamoDb, which may be
+// a DynamoDB Local endpoint such as http://localhost:8000, creates the table
+// when missing and removes entries left by a previous run of node.
+func NewDynamoRegistry(cfg config.ServicesConfig, node string) (*DynamoRegistry, error) {
+	awsConfig := aws.NewConfig().WithRegion(cfg.Region)
+	if cfg.DynamoDb != "" {
+		awsConfig = awsConfig.WithEndpoint(cfg.DynamoDb)
+	}
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+	table := cfg.RegistryTable
+	if table == "" {
+		table = DefaultTable
+	}
+	r := &DynamoRegistry{
+		db:    dynamodb.New(sess),
+		table: table,
+		node:  node,
+		ops:   make(chan func(ctx context.Context) error, 1024),
+		done:  make(chan struct{}),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), startupTimeout)
+	defer cancel()
+	if err := r.ensureTable(ctx); err != nil {
+		return nil, err
+	}
+	if err := r.clearNode(ctx); err != nil {
+		return nil, err
+	}
+
+	go r.run()
+	return r, nil
+}
+
+func (r *DynamoRegistry) Put(e Entry) {
+	e.Node = r.node
+	r.enqueue(func(ctx context.Context) error {
+		item, err := dynamodbattribute.MarshalMap(e)
+		if err != nil {
+			return err
+		}
+		_, err = r.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(r.table),
+			Item:      item,
+		})
+		return err
+	})
+}
+
+func (r *DynamoRegistry) Delete(key, connectionId string) {
+	r.enqueue(func(ctx context.Context) error {
+		_, err := r.db.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(r.table),
+			Key:       itemKey(key, connectionId),
+		})
+		return err
+	})
+}
+
+// Lookup returns the connections of key on all nodes.
+func (r *DynamoRegistry) Lookup(ctx context.Context, key string) ([]Entry, error) {
+	out, err := r.db.QueryWithContext(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String(r.table),
+		KeyConditionExpression:    aws.String("#key = :key"),
+		ExpressionAttributeNames:  map[string]*string{"#key": aws.String("Key")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":key": {S: aws.String(key)}},
+		ConsistentRead:            aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	err = dynamodbattribute.UnmarshalListOfMaps(out.Items, &entries)
+	return entries, err
+}
+
+// Close applies pending updates and stops, or gives up when ctx is done.
+func (r *DynamoRegistry) Close(ctx context.Context) error {
+	r.mu.Lock()
+	if !r.closed {
+		r.closed = true
+		close(r.ops)
+	}
+	r.mu.Unlock()
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *DynamoRegistry) enqueue(op func(ctx context.Context) error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	select {
+	case r.ops <- op:
+	default:
+		slog.Warn("[DynamoRegistry.enqueue] Queue full, dropping update", "table", r.table)
+	}
+}
+
+// run applies updates in order.
+func (r *DynamoRegistry) run() {
+	defer close(r.done)
+	for op := range r.ops {
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		if err := op(ctx); err != nil {
+			slog.Error("[DynamoRegistry.run] Update failed", "err", err)
+		}
+		cancel()
+	}
+}
+
+// ensureTable creates the table when it does not exist.
+func (r *DynamoRegistry) ensureTable(ctx context.Context) error {
+	_, err := r.db.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(r.table)})
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != dynamodb.ErrCodeResourceNotFoundException {
+		return err
+	}
+	slog.Info("[DynamoRegistry.ensureTable] Creating table", "table", r.table)
+	_, err = r.db.CreateTableWithContext(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(r.table),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String("Key"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+			{AttributeName: aws.String("ConnectionId"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("Key"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+			{AttributeName: aws.String("ConnectionId"), KeyType: aws.String(dynamodb.KeyTypeRange)},
+		},
+		BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+	})
+	if err != nil {
+		return err
+	}
+	return r.db.WaitUntilTableExistsWithContext(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(r.table)})
+}
+
+// clearNode removes entries of connections this node had before a restart.
+func (r *DynamoRegistry) clearNode(ctx context.Context) error {
+	var stale []Entry
+	err := r.db.ScanPagesWithContext(ctx, &dynamodb.ScanInput{
+		TableName:                 aws.String(r.table),
+		FilterExpression:          aws.String("#node = :node"),
+		ExpressionAttributeNames:  map[string]*string{"#node": aws.String("Node")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":node": {S: aws.String(r.node)}},
+	}, func(page *dynamodb.ScanOutput, last bool) bool {
+		var entries []Entry
+		if err := dynamodbattribute.UnmarshalListOfMaps(page.Items, &entries); err == nil {
+			stale = append(stale, entries...)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, e := range stale {
+		if _, err := r.db.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(r.table),
+			Key:       itemKey(e.Key, e.ConnectionId),
+		}); err != nil {
+			return err
+		}
+	}
+	if len(stale) > 0 {
+		slog.Info("[DynamoRegistry.clearNode] Removed stale entries", "count", len(stale), "node", r.node)
+	}
+	return nil
+}
+
+func itemKey(key, connectionId string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"Key":          {S: aws.String(key)},
+		"ConnectionId": {S: aws.String(connectionId)},
+	}
+}
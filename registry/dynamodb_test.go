@@ -0,0 +1,68 @@
+package registry
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spoconnor/Go-Client-Connector/config"
+)
+
+// TestDynamoRegistry runs against DynamoDB Local, e.g.
+// docker run -p 8000:8000 amazon/dynamodb-local, with
+// DYNAMODB_ENDPOINT=http://localhost:8000 and any AWS credentials set.
+func TestDynamoRegistry(t *testing.T) {
+	endpoint := os.Getenv("DYNAMODB_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("DYNAMODB_ENDPOINT not set")
+	}
+	cfg := config.ServicesConfig{DynamoDb: endpoint, Region: "us-east-1", RegistryTable: "TestClientConnections"}
+	r, err := NewDynamoRegistry(cfg, "test-node")
+	if err != nil {
+		t.Fatalf("NewDynamoRegistry: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	r.Put(Entry{Key: "Device", ConnectionId: "c1", Connected: time.Now().UTC(), Properties: map[string]string{"tenant": "acme"}})
+	r.Delete("Gone", "c0")
+	if err := r.Close(ctx); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	entries, err := r.Lookup(ctx, "Device")
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Node != "test-node" || entries[0].Properties["tenant"] != "acme" {
+		t.Errorf("Lookup returned %+v", entries)
+	}
+
+	// A restarted node removes its stale entries.
+	r, err = NewDynamoRegistry(cfg, "test-node")
+	if err != nil {
+		t.Fatalf("NewDynamoRegistry: %v", err)
+	}
+	defer r.Close(ctx)
+	if entries, _ := r.Lookup(ctx, "Device"); len(entries) != 0 {
+		t.Errorf("Stale entries left: %+v", entries)
+	}
+}
+
+func TestEnqueueFull(t *testing.T) {
+	r := &DynamoRegistry{table: "t", ops: make(chan func(ctx context.Context) error, 1)}
+	done := make(chan struct{})
+	go func() {
+		r.Delete("Device", "c1")
+		r.Delete("Device", "c2")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Delete blocked on a full queue")
+	}
+	if len(r.ops) != 1 {
+		t.Errorf("%d updates queued; want 1", len(r.ops))
+	}
+}
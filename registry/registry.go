@@ -0,0 +1,22 @@
+package registry
+
+import "time"
+
+// Entry records a connection of a key on a node.
+type Entry struct {
+	Key          string
+	ConnectionId string
+	Node         string // set by the registry
+	Connected    time.Time
+	Properties   map[string]string
+}
+
+// Registry records which keys are connected to which node, for other
+// services to look up. Updates are applied in order, but may be applied
+// after the methods return.
+type Registry interface {
+	// Put records a connection which completed the key handshake.
+	Put(e Entry)
+	// Delete removes the record of a connection.
+	Delete(key, connectionId string)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spoconnor/Go-Client-Connector/config"
+	"github.com/spoconnor/Go-Client-Connector/connections"
+	"github.com/spoconnor/Go-Client-Connector/logging"
+	"github.com/spoconnor/Go-Client-Connector/servers"
+	"github.com/spoconnor/Go-Client-Connector/webhook"
+)
+
+// reloader applies the settings which are safe to change while running: the
+// tls certificate, the logger config, the rate limits and the webhook urls.
+// Other changed settings are only logged, they need a restart.
+type reloader struct {
+	path  string
+	cfg   *config.Config // as started
+	conns *connections.ConnectionsManager
+	hooks *webhook.Sender      // nil when started without webhooks
+	cert  *servers.Certificate // nil without tls
+}
+
+// watch reloads on every SIGHUP.
+func (r *reloader) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			r.reload()
+		}
+	}()
+}
+
+func (r *reloader) reload() {
+	slog.Info("[reloader.reload] Reloading", "path", r.path)
+	if r.cert != nil {
+		if err := r.cert.Reload(); err != nil {
+			slog.Error("[reloader.reload] Reloading tls certificate failed", "err", err)
+		}
+	}
+
+	next := defaults()
+	if err := config.Load(r.path, next); err != nil {
+		slog.Error("[reloader.reload] Invalid config, keeping the current one", "err", err)
+		return
+	}
+	if changed := r.cfg.Restart(next); len(changed) > 0 {
+		slog.Warn("[reloader.reload] Changed settings need a restart", "settings", changed)
+	}
+
+	logConfig, err := logging.LoadConfig(next.LogConfig)
+	if err == nil {
+		err = logging.SetLevel(logConfig.Level)
+	}
+	if err != nil {
+		slog.Error("[reloader.reload] Reloading logger config failed", "err", err)
+	} else {
+		logging.SetPayloads(logConfig.Payloads, logConfig.PayloadLimit, logConfig.Redact)
+	}
+
+	if limits, err := rateLimits(next.Limits); err != nil {
+		slog.Error("[reloader.reload] Reloading rate limits failed", "err", err)
+	} else {
+		r.conns.SetRateLimits(limits)
+	}
+
+	if r.hooks != nil {
+		r.hooks.SetURLs(next.Webhooks.URLs)
+	} else if len(next.Webhooks.URLs) > 0 {
+		slog.Warn("[reloader.reload] Webhooks need a restart, they were disabled at startup")
+	}
+}
@@ -0,0 +1,111 @@
+package servers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/spoconnor/Go-Client-Connector/cluster"
+	contracts "github.com/spoconnor/Go-Client-Connector/contracts"
+	"github.com/spoconnor/Go-Client-Connector/logging"
+	"github.com/spoconnor/Go-Client-Connector/tracing"
+
+	"github.com/go-ozzo/ozzo-routing"
+)
+
+// Node-to-node endpoints, served when the RestServer has a Cluster.
+
+// clusterAuth rejects requests without the cluster secret, when one is set.
+func (r *RestServer) clusterAuth(c *routing.Context) error {
+	secret := r.Cluster.Secret()
+	if secret == "" {
+		return nil
+	}
+	given := c.Request.Header.Get("Authorization")
+	if subtle.ConstantTimeCompare([]byte(given), []byte("Bearer "+secret)) != 1 {
+		slog.Warn("[RestServer.clusterAuth] Rejected", "path", c.Request.URL.Path, logging.RemoteAddrAttr, c.Request.RemoteAddr)
+		return routing.NewHTTPError(http.StatusUnauthorized)
+	}
+	return nil
+}
+
+// clusterState applies the state of a peer and answers with the state of
+// this node.
+func (r *RestServer) clusterState(c *routing.Context) error {
+	var m cluster.StateMessage
+	if err := decodeClusterMessage(c, &m); err != nil {
+		return err
+	}
+	if !r.Cluster.ApplyState(&m) {
+		return routing.NewHTTPError(http.StatusForbidden, "unknown node '"+m.Node+"'")
+	}
+	return c.Write(cluster.StateMessage{Node: r.Cluster.Node(), Keys: r.connectionsManager.Keys()})
+}
+
+func (r *RestServer) clusterAnnounce(c *routing.Context) error {
+	var m cluster.AnnounceMessage
+	if err := decodeClusterMessage(c, &m); err != nil {
+		return err
+	}
+	if !r.Cluster.ApplyAnnounce(&m) {
+		return routing.NewHTTPError(http.StatusForbidden, "unknown node '"+m.Node+"'")
+	}
+	return nil
+}
+
+// clusterCall sends a call forwarded by a peer to a key connected here.
+func (r *RestServer) clusterCall(c *routing.Context) error {
+	var m cluster.CallMessage
+	if err := decodeClusterMessage(c, &m); err != nil {
+		return err
+	}
+	logging.Message(slog.Default(), "[RestServer.clusterCall] Received", m.Params, logging.KeyAttr, m.Key, "method", m.Method)
+
+	// Continue the trace of the forwarding node.
+	c.Request = c.Request.WithContext(tracing.FromHeader(c.Request.Context(), c.Request.Header))
+	ctx, cancel, err := callContext(c)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	res, err := r.connectionsManager.SendToLocalClient(ctx, m.Key, m.Method, m.Params, m.WaitForReply)
+	if err != nil {
+		return callError(err)
+	}
+	if res == nil {
+		return c.Write(contracts.RpcResponse{})
+	}
+	return c.Write(res)
+}
+
+func (r *RestServer) clusterBroadcast(c *routing.Context) error {
+	var m cluster.BroadcastMessage
+	if err := decodeClusterMessage(c, &m); err != nil {
+		return err
+	}
+	if err := r.connectionsManager.BroadcastLocal(m.Method, m.Params); err != nil {
+		return callError(err)
+	}
+	return nil
+}
+
+func (r *RestServer) clusterPublish(c *routing.Context) error {
+	var m cluster.PublishMessage
+	if err := decodeClusterMessage(c, &m); err != nil {
+		return err
+	}
+	if _, err := r.connectionsManager.PublishLocal(m.Topic, m.Method, m.Params); err != nil {
+		return callError(err)
+	}
+	return nil
+}
+
+func decodeClusterMessage(c *routing.Context, m interface{}) error {
+	if err := json.NewDecoder(c.Request.Body).Decode(m); err != nil {
+		slog.Info("[RestServer.cluster] Bad request", "err", err)
+		return routing.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return nil
+}
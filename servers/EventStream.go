@@ -0,0 +1,263 @@
+package servers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spoconnor/Go-Client-Connector/connections"
+	"github.com/spoconnor/Go-Client-Connector/logging"
+
+	"github.com/go-ozzo/ozzo-routing"
+)
+
+// DefaultEventBuffer is how many events are kept for resuming streams.
+const DefaultEventBuffer = 1000
+
+// eventKeepAlive is how often idle streams get a comment, so proxies keep
+// them open.
+const eventKeepAlive = 15 * time.Second
+
+// subscriberBuffer is how many events a stream may fall behind before it is
+// closed. The client can resume it with Last-Event-ID.
+const subscriberBuffer = 256
+
+// streamedEvent is an event with its stream id.
+type streamedEvent struct {
+	id uint64
+	e  *connections.Event
+}
+
+// eventFilter selects events of a stream. Empty fields select everything.
+type eventFilter struct {
+	keys       map[string]bool
+	types      map[string]bool
+	properties map[string]string
+}
+
+func (f *eventFilter) match(e *connections.Event) bool {
+	if len(f.keys) > 0 && !f.keys[e.Key] {
+		return false
+	}
+	if len(f.types) > 0 && !f.types[e.Type] {
+		return false
+	}
+	for k, v := range f.properties {
+		if p, ok := e.Properties[k]; !ok || p != v {
+			return false
+		}
+	}
+	return true
+}
+
+// eventSubscriber is an open stream.
+type eventSubscriber struct {
+	filter *eventFilter
+	events chan streamedEvent // closed when the stream falls behind or closes
+}
+
+// EventStream keeps the latest connection events in a ring buffer and
+// streams them to subscribers as Server-Sent Events. Register Publish with
+// ConnectionsManager.OnEvent.
+type EventStream struct {
+	mu     sync.Mutex
+	ring   []streamedEvent
+	next   uint64 // id of the next event, starting at 1
+	subs   map[*eventSubscriber]struct{}
+	closed bool
+}
+
+// NewEventStream creates a stream keeping size events.
+func NewEventStream(size int) *EventStream {
+	if size <= 0 {
+		size = DefaultEventBuffer
+	}
+	return &EventStream{
+		ring: make([]streamedEvent, size),
+		next: 1,
+		subs: make(map[*eventSubscriber]struct{}),
+	}
+}
+
+// Publish adds e to the buffer and sends it to matching subscribers.
+// Subscribers which fell behind are closed.
+func (s *EventStream) Publish(e *connections.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	se := streamedEvent{id: s.next, e: e}
+	s.ring[int((s.next-1)%uint64(len(s.ring)))] = se
+	s.next++
+	for sub := range s.subs {
+		if !sub.filter.match(e) {
+			continue
+		}
+		select {
+		case sub.events <- se:
+		default:
+			slog.Warn("[EventStream.Publish] Closing stream which fell behind")
+			delete(s.subs, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// Close ends all streams.
+func (s *EventStream) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for sub := range s.subs {
+		delete(s.subs, sub)
+		close(sub.events)
+	}
+}
+
+// subscribe opens a stream, returning the buffered events after lastId
+// matching filter.
+func (s *EventStream) subscribe(filter *eventFilter, lastId uint64) (*eventSubscriber, []streamedEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub := &eventSubscriber{filter: filter, events: make(chan streamedEvent, subscriberBuffer)}
+	if s.closed {
+		close(sub.events)
+		return sub, nil
+	}
+	s.subs[sub] = struct{}{}
+
+	var missed []streamedEvent
+	first := uint64(1)
+	if s.next > uint64(len(s.ring)) {
+		first = s.next - uint64(len(s.ring))
+	}
+	if lastId+1 > first {
+		first = lastId + 1
+	}
+	for id := first; id < s.next; id++ {
+		se := s.ring[int((id-1)%uint64(len(s.ring)))]
+		if filter.match(se.e) {
+			missed = append(missed, se)
+		}
+	}
+	return sub, missed
+}
+
+func (s *EventStream) unsubscribe(sub *eventSubscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.subs[sub]; ok {
+		delete(s.subs, sub)
+		close(sub.events)
+	}
+}
+
+//-------------------------------------------------
+
+// @Title events
+// @Description Stream connection and rpc events as Server-Sent Events
+// @Produce text/event-stream
+// @Param key query string false "Only events of this key, may be repeated"
+// @Param type query string false "Only events of these comma separated types"
+// @Param property query string false "Only events of connections with this name=value property, may be repeated"
+// @Param Last-Event-ID header string false "Resume after this event id"
+// @Success 200 {object} connections.Event "One event per message"
+// @Failure 400 {string} Bad request
+// @Router /events [get]
+func (r *RestServer) events(c *routing.Context) error {
+	filter, err := parseEventFilter(c.Request)
+	if err != nil {
+		return routing.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	var lastId uint64
+	last := c.Request.Header.Get("Last-Event-ID")
+	if last == "" {
+		last = c.Query("lastEventId")
+	}
+	if last != "" {
+		if lastId, err = strconv.ParseUint(last, 10, 64); err != nil {
+			return routing.NewHTTPError(http.StatusBadRequest, "invalid Last-Event-ID '"+last+"'")
+		}
+	}
+	flusher := flusherOf(c.Response)
+	if flusher == nil {
+		return routing.NewHTTPError(http.StatusInternalServerError, "streaming not supported")
+	}
+	slog.Info("[RestServer.events] Streaming", logging.RemoteAddrAttr, c.Request.RemoteAddr, "after", lastId)
+
+	sub, missed := r.Events.subscribe(filter, lastId)
+	defer r.Events.unsubscribe(sub)
+
+	h := c.Response.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Connection", "keep-alive")
+	c.Response.WriteHeader(http.StatusOK)
+	for _, se := range missed {
+		if err := writeEvent(c.Response, se); err != nil {
+			return nil
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return nil
+		case se, ok := <-sub.events:
+			if !ok {
+				return nil
+			}
+			if err := writeEvent(c.Response, se); err != nil {
+				return nil
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(c.Response, ": keep-alive\n\n"); err != nil {
+				return nil
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, se streamedEvent) error {
+	data, err := json.Marshal(se.e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", se.id, se.e.Type, data)
+	return err
+}
+
+// parseEventFilter reads the key, type and property query parameters.
+func parseEventFilter(req *http.Request) (*eventFilter, error) {
+	q := req.URL.Query()
+	f := &eventFilter{
+		keys:       make(map[string]bool),
+		types:      make(map[string]bool),
+		properties: make(map[string]string),
+	}
+	for _, key := range q["key"] {
+		f.keys[key] = true
+	}
+	for _, types := range q["type"] {
+		for _, t := range strings.Split(types, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				f.types[t] = true
+			}
+		}
+	}
+	for _, p := range q["property"] {
+		i := strings.Index(p, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("property '%s' is not name=value", p)
+		}
+		f.properties[p[:i]] = p[i+1:]
+	}
+	return f, nil
+}
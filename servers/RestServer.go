@@ -3,10 +3,15 @@
 package servers
 
 import (
-	"log"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
 	"net/http"
 
+	"github.com/spoconnor/Go-Client-Connector/cluster"
 	"github.com/spoconnor/Go-Client-Connector/connections"
+	"github.com/spoconnor/Go-Client-Connector/metrics"
 
 	"github.com/go-ozzo/ozzo-routing"
 	"github.com/go-ozzo/ozzo-routing/access"
@@ -15,32 +20,55 @@ import (
 	"github.com/go-ozzo/ozzo-routing/slash"
 )
 
+// DefaultPrefix is the prefix of every route.
+const DefaultPrefix = cluster.DefaultPrefix
+
 type RestServer struct {
 	connectionsManager *connections.ConnectionsManager
 	Listening          bool
+
+	// TLS, when set, makes the server serve https:// only.
+	TLS *tls.Config
+
+	// Cluster, when set, serves the node-to-node endpoints.
+	Cluster *cluster.Cluster
+
+	// Events, when set, is served as an event stream at /Events.
+	Events *EventStream
+
+	// Prefix is the prefix of every route, e.g. /ClientConnector.
+	Prefix string
+
+	server *http.Server
 }
 
-func NewRestServer(c *connections.ConnectionsManager) *RestServer {
+func NewRestServer(c *connections.ConnectionsManager, addr string) *RestServer {
 	r := &RestServer{
 		connectionsManager: c,
 		Listening:          false,
+		Prefix:             DefaultPrefix,
+		server:             &http.Server{Addr: addr},
 	}
 	return r
 }
 
 func (r *RestServer) Start() {
-	log.Println("Starting Rest Server at http://localhost:9000/ClientConnector...")
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	slog.Info("[RestServer.Start] Starting", "url", scheme+"://"+r.server.Addr+r.Prefix)
 	router := routing.New()
 
 	router.Use(
 		// all these handlers are shared by every route
-		access.Logger(log.Printf),
+		access.Logger(logf(slog.LevelInfo, "[RestServer] Access")),
 		slash.Remover(http.StatusMovedPermanently),
-		fault.Recovery(log.Printf),
+		fault.Recovery(logf(slog.LevelError, "[RestServer] Request failed")),
 	)
 
 	// serve RESTful APIs
-	api := router.Group("/ClientConnector")
+	api := router.Group(r.Prefix)
 	api.Use(
 		// these handlers are shared by the routes in the api group only
 		content.TypeNegotiator(content.JSON),
@@ -52,6 +80,31 @@ func (r *RestServer) Start() {
 
 	api.Get(`/Key/<key>/Ping`, r.ping)
 	api.Post("/Key/<key>/JsonRpc", r.jsonRpc)
+	api.Get("/Key/<key>/Queue", r.queue)
+	api.Delete("/Key/<key>/Queue", r.purgeQueue)
+	api.Get("/Key/<key>/Presence", r.presence)
+	api.Get("/DeadLetters", r.deadLetters)
+	api.Delete(`/DeadLetters/<id:\d+>`, r.deleteDeadLetter)
+	api.Post("/Keys/JsonRpc", r.multicast)
+	api.Post("/Gather", r.gather)
+
+	// Topic names contain '/', so the action is split off in the handler.
+	api.Post(`/Topic/<topic:.+>`, r.topicAction("Publish", r.publish))
+	api.Get(`/Topic/<topic:.+>`, r.topicAction("Subscribers", r.subscribers))
+
+	if r.Events != nil {
+		api.Get("/Events", r.events)
+	}
+
+	if r.Cluster != nil {
+		peers := api.Group("/Cluster")
+		peers.Use(r.clusterAuth)
+		peers.Post("/State", r.clusterState)
+		peers.Post("/Announce", r.clusterAnnounce)
+		peers.Post("/Call", r.clusterCall)
+		peers.Post("/Broadcast", r.clusterBroadcast)
+		peers.Post("/Publish", r.clusterPublish)
+	}
 
 	/*
 		// serve index file
@@ -62,10 +115,39 @@ func (r *RestServer) Start() {
 		}))
 	*/
 
+	http.Handle("/metrics", metrics.Handler())
 	http.Handle("/", router)
 	r.Listening = true // TODO get state from http somehow?
-	http.ListenAndServe(":9000", nil)
-	log.Println("Stopping Rest Server...")
+	var err error
+	if r.TLS != nil {
+		// Certificates come from the config.
+		r.server.TLSConfig = r.TLS
+		err = r.server.ListenAndServeTLS("", "")
+	} else {
+		err = r.server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		slog.Error("[RestServer.Start] Error", "err", err)
+	}
+	r.Listening = false
+	slog.Info("[RestServer.Start] Stopped")
+}
+
+// Shutdown ends event streams, stops accepting requests and waits for active
+// ones to finish, or ctx to be done.
+func (r *RestServer) Shutdown(ctx context.Context) error {
+	if r.Events != nil {
+		r.Events.Close()
+	}
+	return r.server.Shutdown(ctx)
 }
 
 //-------------------------------------------------
+
+// logf adapts slog to the printf style loggers of the ozzo handlers, logging
+// each formatted line as the "line" attribute of msg.
+func logf(level slog.Level, msg string) func(format string, a ...interface{}) {
+	return func(format string, a ...interface{}) {
+		slog.Log(context.Background(), level, msg, "line", fmt.Sprintf(format, a...))
+	}
+}
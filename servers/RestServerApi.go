@@ -3,12 +3,23 @@
 package servers
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/spoconnor/Go-Client-Connector/connections"
 	contracts "github.com/spoconnor/Go-Client-Connector/contracts"
+	"github.com/spoconnor/Go-Client-Connector/logging"
+	"github.com/spoconnor/Go-Client-Connector/store"
+	"github.com/spoconnor/Go-Client-Connector/tracing"
 
 	"github.com/go-ozzo/ozzo-routing"
+	"github.com/go-ozzo/ozzo-routing/access"
+	"go.opentelemetry.io/otel/trace"
 )
 
 //-------------------------------------------------
@@ -18,61 +29,431 @@ import (
 // @Success 200 {string} Reponse message
 // @Router /hello [get]
 func (r *RestServer) hello(c *routing.Context) error {
-	log.Println("[RestServer.hello]")
+	slog.Debug("[RestServer.hello]")
 	c.Write("Hello")
 	return nil
 }
 
 // @Title listConnections
-// @Description List all client connections
-// @Success 200 {array} Client connections
+// @Description List all client connections and the duplicate key policy in effect
+// @Success 200 {object} connections.ConnectionList
 // @Router /listConnections [get]
 func (r *RestServer) listConnections(c *routing.Context) error {
-	log.Println("[RestServer.listConnections]")
+	slog.Debug("[RestServer.listConnections]")
 	var res = r.connectionsManager.ListConnections()
-	c.Write(res)
-	return nil
+	return c.Write(res)
 }
 
 // @Title ping
 // @Description Test connection to a specified client
+// @Param key path string true "Client Id"
+// @Param timeout query string false "Reply deadline, e.g. 5s"
 // @Success 200 {string} Reponse message
+// @Failure 404 {string} Client not connected
+// @Failure 504 {string} Client did not reply in time
 // @Router /ping/key/{key} [get]
 func (r *RestServer) ping(c *routing.Context) error {
-	log.Println("[RestServer.ping]")
+	slog.Debug("[RestServer.ping]")
 	key := c.Param("key")
 	//message := c.Query("message")
-	res, err := r.connectionsManager.SendToClient(key, "Ping", nil, true)
+	ctx, cancel, err := callContext(c)
 	if err != nil {
-		c.Write(res)
+		return err
 	}
-	return err
+	defer cancel()
+
+	res, err := r.connectionsManager.SendToClient(ctx, key, "Ping", nil, true)
+	if err != nil {
+		return callError(err)
+	}
+	return c.Write(res)
 }
 
 // @Title jsonRpc
 // @Description Send a json rpc message to a specified client
 // @Accept json
 // @Param key path string true "Client Id"
+// @Param timeout query string false "Reply deadline, e.g. 5s"
+// @Param queue query bool false "Queue the message as a notification when the client is offline"
 // @Param req body contracts.RpcRequest true "Rpc request"
 // @Success 200 {string} Reponse message
+// @Success 202 {object} servers.QueueResult Message queued
+// @Failure 400 {object} contracts.RpcError Client rejected the request as invalid
+// @Failure 404 {string} Client not connected
+// @Failure 501 {object} contracts.RpcError Client does not know the method
+// @Failure 429 {string} Offline queue full
+// @Failure 502 {object} contracts.RpcError Client replied with another error
+// @Failure 504 {string} Client did not reply in time
 // @Router /jsonRpc/key/{key} [get]
-func (r *RestServer) jsonRpc(c *routing.Context) error {
-	log.Println("[RestServer.jsonRpc]")
+func (r *RestServer) jsonRpc(c *routing.Context) (err error) {
 	key := c.Param("key")
+	ctx, span := tracing.Start(tracing.FromHeader(c.Request.Context(), c.Request.Header), "RestServer.jsonRpc",
+		trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(tracing.KeyAttribute.String(key)))
+	defer func() { tracing.End(span, err) }()
+	c.Request = c.Request.WithContext(ctx)
+
 	var req contracts.RpcRequest
 	if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil {
-		log.Fatal(err)
+		slog.Info("[RestServer.jsonRpc] Bad request", "err", err)
+		return routing.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	logging.Message(slog.Default(), "[RestServer.jsonRpc] Received", req.Params, logging.KeyAttr, key, "method", req.Method)
+	span.SetAttributes(tracing.MethodAttribute.String(req.Method))
+
+	if c.Query("queue") == "true" {
+		queued, err := r.connectionsManager.QueueIfOffline(key, req.Method, req.Params)
+		if err != nil {
+			return callError(err)
+		}
+		if queued {
+			res := QueueResult{Key: key}
+			if q := r.connectionsManager.Offline; q != nil {
+				msgs, _ := q.Peek(key)
+				res.Queued = len(msgs)
+			}
+			c.Response.Header().Set("Content-Type", "application/json")
+			c.Response.WriteHeader(http.StatusAccepted)
+			return c.Write(res)
+		}
+	}
+
+	ctx, cancel, err := callContext(c)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	res, err := r.connectionsManager.SendToClient(ctx, key, req.Method, req.Params, true)
+	if err != nil {
+		slog.Info("[RestServer.jsonRpc] Error", logging.KeyAttr, key, "method", req.Method, "err", err)
+		return callError(err)
+	}
+	if res.Error != nil {
+		slog.Info("[RestServer.jsonRpc] Client replied with error", logging.KeyAttr, key, "method", req.Method, "code", res.Error.Code, "err", res.Error.Message)
+		c.Response.Header().Set("Content-Type", "application/json")
+		c.Response.WriteHeader(rpcErrorStatus(res.Error))
+		return c.Write(res.Error)
+	}
+	json, _ := json.Marshal(res.Result)
+	logging.Message(slog.Default(), "[RestServer.jsonRpc] Replying", res.Result, logging.KeyAttr, key, "method", req.Method)
+	return c.Write(string(json))
+}
+
+// QueueResult tells how many messages are queued for an offline key.
+// Messages held by a suspended session, without an offline queue, are not
+// counted.
+type QueueResult struct {
+	Key    string
+	Queued int
+}
+
+// @Title queue
+// @Description List notifications queued for an offline client
+// @Param key path string true "Client Id"
+// @Success 200 {array} store.QueuedMessage
+// @Router /key/{key}/queue [get]
+func (r *RestServer) queue(c *routing.Context) error {
+	key := c.Param("key")
+	slog.Debug("[RestServer.queue]", logging.KeyAttr, key)
+	if r.connectionsManager.Offline == nil {
+		return c.Write([]store.QueuedMessage{})
+	}
+	msgs, err := r.connectionsManager.Offline.Peek(key)
+	if err != nil {
+		return err
+	}
+	return c.Write(msgs)
+}
+
+// @Title purgeQueue
+// @Description Drop notifications queued for an offline client
+// @Param key path string true "Client Id"
+// @Success 200 {object} servers.QueueResult Number of dropped messages
+// @Router /key/{key}/queue [delete]
+func (r *RestServer) purgeQueue(c *routing.Context) error {
+	key := c.Param("key")
+	slog.Debug("[RestServer.purgeQueue]", logging.KeyAttr, key)
+	n := 0
+	if r.connectionsManager.Offline != nil {
+		var err error
+		if n, err = r.connectionsManager.Offline.Purge(key); err != nil {
+			return err
+		}
+	}
+	return c.Write(QueueResult{Key: key, Queued: n})
+}
+
+// @Title presence
+// @Description List when a client connected and disconnected, oldest first
+// @Param key path string true "Client Id"
+// @Success 200 {array} store.PresenceEvent
+// @Router /key/{key}/presence [get]
+func (r *RestServer) presence(c *routing.Context) error {
+	key := c.Param("key")
+	slog.Debug("[RestServer.presence]", logging.KeyAttr, key)
+	events, err := r.connectionsManager.Store.Presence(key)
+	if err != nil {
+		return err
+	}
+	if events == nil {
+		events = []store.PresenceEvent{}
+	}
+	return c.Write(events)
+}
+
+// @Title deadLetters
+// @Description List messages which could not be delivered, oldest first
+// @Param limit query int false "Maximum number of dead letters"
+// @Success 200 {array} store.DeadLetter
+// @Router /deadLetters [get]
+func (r *RestServer) deadLetters(c *routing.Context) error {
+	slog.Debug("[RestServer.deadLetters]")
+	limit := 0
+	if l := c.Query("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil {
+			return routing.NewHTTPError(http.StatusBadRequest, "invalid limit '"+l+"'")
+		}
+	}
+	dead, err := r.connectionsManager.Store.DeadLetters(limit)
+	if err != nil {
+		return err
+	}
+	if dead == nil {
+		dead = []store.DeadLetter{}
+	}
+	return c.Write(dead)
+}
+
+// @Title deleteDeadLetter
+// @Description Drop a dead letter
+// @Param id path int true "Dead letter id"
+// @Success 200 {string} Reponse message
+// @Router /deadLetters/{id} [delete]
+func (r *RestServer) deleteDeadLetter(c *routing.Context) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return routing.NewHTTPError(http.StatusBadRequest, "invalid id '"+c.Param("id")+"'")
+	}
+	slog.Debug("[RestServer.deleteDeadLetter]", "id", id)
+	if err := r.connectionsManager.Store.DeleteDeadLetter(id); err != nil {
+		return err
+	}
+	return c.Write("Deleted")
+}
+
+// MulticastRequest is a request sent to many keys.
+type MulticastRequest struct {
+	Keys         []string
+	Method       string
+	Params       contracts.RpcParams
+	WaitForReply bool
+}
+
+// @Title multicast
+// @Description Send a json rpc message to many clients, reporting the outcome for each key
+// @Accept json
+// @Param timeout query string false "Reply deadline, e.g. 5s"
+// @Param req body servers.MulticastRequest true "Keys and rpc request"
+// @Success 200 {object} map[string]connections.KeyResult
+// @Failure 400 {string} Bad request
+// @Router /keys/jsonRpc [post]
+func (r *RestServer) multicast(c *routing.Context) error {
+	var req MulticastRequest
+	if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil {
+		slog.Info("[RestServer.multicast] Bad request", "err", err)
+		return routing.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if req.Method == "" {
+		return routing.NewHTTPError(http.StatusBadRequest, "missing method")
+	}
+	logging.Message(slog.Default(), "[RestServer.multicast] Received", req.Params, "method", req.Method, "keys", len(req.Keys))
+
+	ctx, cancel, err := callContext(c)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	res, err := r.connectionsManager.SendToKeys(ctx, req.Keys, req.Method, req.Params, req.WaitForReply)
+	if err != nil {
+		return callError(err)
+	}
+	return c.Write(res)
+}
+
+// GatherRequest is a request sent to all connections matching Filter.
+type GatherRequest struct {
+	Method string
+	Params contracts.RpcParams
+	Filter map[string]string // connection properties to match
+	Quorum int               // replies to wait for, 0 for all
+}
+
+// @Title gather
+// @Description Send a json rpc message to all matching clients and stream their answers as they arrive
+// @Accept json
+// @Produce application/x-ndjson
+// @Param timeout query string false "Reply deadline, e.g. 5s"
+// @Param req body servers.GatherRequest true "Rpc request, property filter and quorum"
+// @Success 200 {object} connections.GatherResult "One json object per line"
+// @Failure 400 {string} Bad request
+// @Router /gather [post]
+func (r *RestServer) gather(c *routing.Context) error {
+	var req GatherRequest
+	if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil {
+		slog.Info("[RestServer.gather] Bad request", "err", err)
+		return routing.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if req.Method == "" {
+		return routing.NewHTTPError(http.StatusBadRequest, "missing method")
+	}
+	logging.Message(slog.Default(), "[RestServer.gather] Received", req.Params, "method", req.Method, "filter", req.Filter)
+
+	ctx, cancel, err := callContext(c)
+	if err != nil {
 		return err
 	}
-	log.Printf("[RestServer.jsonRpc] received '%s' for '%s'", req.Method, key)
+	defer cancel()
 
-	res, err := r.connectionsManager.SendToClient(key, req.Method, req.Params, true)
+	results, err := r.connectionsManager.Gather(ctx, req.Method, req.Params, req.Filter, req.Quorum)
 	if err != nil {
-		log.Printf("[RestServer.jsonRpc] Error '%v'", err)
-	} else {
-		json, _ := json.Marshal(res.Result)
-		log.Printf("[RestServer.jsonRpc] sending '%s'", json)
-		c.Write(string(json))
+		return callError(err)
+	}
+
+	c.Response.Header().Set("Content-Type", "application/x-ndjson")
+	c.Response.WriteHeader(http.StatusOK)
+	flusher := flusherOf(c.Response)
+	enc := json.NewEncoder(c.Response)
+	for res := range results {
+		if err := enc.Encode(res); err != nil {
+			slog.Info("[RestServer.gather] Error", "err", err)
+			cancel()
+			continue // Drain, the channel is closed once cancelled.
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	return nil
+}
+
+// PublishResult tells to how many subscribers a message was published.
+type PublishResult struct {
+	Topic       string
+	Subscribers int
+}
+
+// @Title publish
+// @Description Send a notification to all clients subscribed to a topic
+// @Accept json
+// @Param topic path string true "Topic name"
+// @Param req body contracts.RpcRequest true "Rpc notification, Id is ignored"
+// @Success 200 {object} servers.PublishResult
+// @Failure 400 {string} Bad request
+// @Router /topic/{topic}/publish [post]
+func (r *RestServer) publish(c *routing.Context, topic string) error {
+	slog.Debug("[RestServer.publish]", "topic", topic)
+	var req contracts.RpcRequest
+	if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil {
+		slog.Info("[RestServer.publish] Bad request", "err", err)
+		return routing.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if req.Method == "" {
+		return routing.NewHTTPError(http.StatusBadRequest, "missing method")
+	}
+
+	n, err := r.connectionsManager.Publish(topic, req.Method, req.Params)
+	if err == connections.ErrInvalidTopic {
+		return routing.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err != nil {
+		return callError(err)
+	}
+	return c.Write(PublishResult{Topic: topic, Subscribers: n})
+}
+
+// @Title subscribers
+// @Description List clients subscribed to a topic
+// @Param topic path string true "Topic name"
+// @Success 200 {array} connections.ConnectionInfo
+// @Router /topic/{topic}/subscribers [get]
+func (r *RestServer) subscribers(c *routing.Context, topic string) error {
+	slog.Debug("[RestServer.subscribers]", "topic", topic)
+	return c.Write(r.connectionsManager.Subscribers(topic))
+}
+
+//-------------------------------------------------
+
+// topicAction handles /Topic/<topic>/<action> routes, passing the topic to
+// handler. Other paths are not found.
+func (r *RestServer) topicAction(action string, handler func(*routing.Context, string) error) routing.Handler {
+	return func(c *routing.Context) error {
+		topic := strings.TrimSuffix(c.Param("topic"), "/"+action)
+		if topic == c.Param("topic") || topic == "" {
+			return routing.NewHTTPError(http.StatusNotFound)
+		}
+		return handler(c, topic)
+	}
+}
+
+// flusherOf returns the http.Flusher of w, looking through the access log
+// wrapper, or nil.
+func flusherOf(w http.ResponseWriter) http.Flusher {
+	for {
+		switch t := w.(type) {
+		case http.Flusher:
+			return t
+		case *access.LogResponseWriter:
+			w = t.ResponseWriter
+		default:
+			return nil
+		}
+	}
+}
+
+// callContext derives the context of a client call from the HTTP request,
+// so the call is cancelled when the caller goes away. An optional "timeout"
+// query parameter sets the call deadline.
+func callContext(c *routing.Context) (context.Context, context.CancelFunc, error) {
+	ctx := c.Request.Context()
+	timeout := c.Query("timeout")
+	if timeout == "" {
+		ctx, cancel := context.WithCancel(ctx)
+		return ctx, cancel, nil
+	}
+	d, err := time.ParseDuration(timeout)
+	if err != nil || d <= 0 {
+		return nil, nil, routing.NewHTTPError(http.StatusBadRequest, "invalid timeout '"+timeout+"'")
+	}
+	ctx, cancel := context.WithTimeout(ctx, d)
+	return ctx, cancel, nil
+}
+
+// rpcErrorStatus maps the error a client replied with to an HTTP status.
+func rpcErrorStatus(e *contracts.RpcError) int {
+	switch e.Code {
+	case contracts.ParserError, contracts.InvalidRequest, contracts.InvalidParams:
+		return http.StatusBadRequest
+	case contracts.MethodNotFound:
+		return http.StatusNotImplemented
+	}
+	return http.StatusBadGateway
+}
+
+// callError maps errors of client calls to HTTP errors.
+func callError(err error) error {
+	switch err.(type) {
+	case *connections.TimeoutError:
+		return routing.NewHTTPError(http.StatusGatewayTimeout, err.Error())
+	}
+	switch err {
+	case connections.ErrNotConnected:
+		return routing.NewHTTPError(http.StatusNotFound, err.Error())
+	case connections.ErrShuttingDown, connections.ErrConnectionClosed:
+		return routing.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+	case connections.ErrQueueFull:
+		return routing.NewHTTPError(http.StatusTooManyRequests, err.Error())
 	}
 	return err
 }
@@ -1,8 +1,17 @@
 package servers
 
 import (
-	"log"
+	"bufio"
+	"context"
+	"crypto/tls"
+	"log/slog"
 	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gobwas/ws"
@@ -10,16 +19,40 @@ import (
 
 	_ "net/http/pprof"
 
+	"github.com/spoconnor/Go-Client-Connector/auth"
 	"github.com/spoconnor/Go-Client-Connector/connections"
+	"github.com/spoconnor/Go-Client-Connector/contracts"
+	"github.com/spoconnor/Go-Client-Connector/logging"
+	"github.com/spoconnor/Go-Client-Connector/metrics"
 	"github.com/spoconnor/Go-Common-Code/gopool"
 )
 
 type WebSocketServer struct {
-	pool               *gopool.Pool
+	pool               *connections.WorkerPool
 	ConnectionsManager *connections.ConnectionsManager
 	addr               string
 	ioTimeout          time.Duration
 	Listening          bool
+
+	mu         sync.Mutex // guards fields below
+	closing    bool
+	poller     netpoll.Poller
+	ln         net.Listener
+	acceptDesc *netpoll.Desc
+	exit       chan struct{}
+
+	// WireFormat is used by clients which do not select one with a
+	// websocket subprotocol.
+	WireFormat contracts.WireFormat
+
+	// Tokens, when set, requires a valid bearer token to upgrade. The token
+	// is taken from the Authorization header or the TokenQueryParam query
+	// parameter.
+	Tokens          *auth.TokenValidator
+	TokenQueryParam string
+
+	// TLS, when set, makes the server accept wss:// connections only.
+	TLS *tls.Config
 }
 
 func NetWebSocketServer(addr string, ioTimeout time.Duration, workers, queue int) *WebSocketServer {
@@ -27,11 +60,14 @@ func NetWebSocketServer(addr string, ioTimeout time.Duration, workers, queue int
 		addr:      addr,
 		ioTimeout: ioTimeout,
 		Listening: false,
+		exit:      make(chan struct{}),
 	}
 	// Make pool of X size, Y sized work queue and one pre-spawned
 	// goroutine.
-	w.pool = gopool.NewPool(workers, queue, 1)
-	w.ConnectionsManager = connections.NewConnectionsManager(w.pool)
+	pool := gopool.NewPool(workers, queue, 1)
+	w.ConnectionsManager = connections.NewConnectionsManager(pool)
+	// Schedule through the manager, so shutdown can drain our tasks too.
+	w.pool = w.ConnectionsManager.Pool()
 	return w
 }
 
@@ -41,47 +77,104 @@ func (w *WebSocketServer) Start() {
 	// events from listener of user connections.
 	poller, err := netpoll.New(nil)
 	if err != nil {
-		log.Fatal(err)
+		slog.Error("[WebSocketServer.Start] Creating poller failed", "err", err)
+		os.Exit(1)
 	}
 
-	var exit = make(chan struct{})
-
 	// handle is a new incoming connection handler.
 	// It upgrades TCP connection to WebSocket, registers netpoll listener on
 	// it and stores it as a user in Connection instance.
 	//
 	// We will call it below within accept() loop.
 	handle := func(conn net.Conn) {
+		raw := conn // polled for readiness, also when wrapped in tls
+		var tlsConn *bufferedConn
+		if w.TLS != nil {
+			tlsConn = newBufferedConn(tls.Server(conn, w.TLS))
+			conn = tlsConn
+		}
+
 		// NOTE: we wrap conn here to show that ws could work with any kind of
 		// io.ReadWriter.
 		safeConn := deadliner{conn, w.ioTimeout}
 
+		// Clients may pick their wire format with a subprotocol.
+		format := w.WireFormat
+		var token string
+		var properties map[string]string
+		upgrader := ws.Upgrader{
+			Protocol: func(p []byte) bool {
+				f, ok := contracts.WireFormatForSubprotocol(string(p))
+				if ok {
+					format = f
+				}
+				return ok
+			},
+			OnRequest: func(uri []byte) error {
+				if u, err := url.ParseRequestURI(string(uri)); err == nil && w.TokenQueryParam != "" {
+					token = u.Query().Get(w.TokenQueryParam)
+				}
+				return nil
+			},
+			OnHeader: func(key, value []byte) error {
+				if strings.EqualFold(string(key), "Authorization") {
+					token, _ = auth.BearerToken(string(value))
+				}
+				return nil
+			},
+			OnBeforeUpgrade: func() (ws.HandshakeHeader, error) {
+				if w.Tokens == nil {
+					return nil, nil
+				}
+				claims, err := w.Tokens.Validate(token)
+				if err != nil {
+					slog.Info("[WebSocketServer.Start] Token rejected", logging.RemoteAddrAttr, conn.RemoteAddr().String(), "err", err)
+					return nil, ws.RejectConnectionError(
+						ws.RejectionStatus(http.StatusUnauthorized),
+						ws.RejectionHeader(ws.HandshakeHeaderString("WWW-Authenticate: Bearer\r\n")),
+					)
+				}
+				properties = claimProperties(claims)
+				return nil, nil
+			},
+		}
+
 		// Zero-copy upgrade to WebSocket connection.
-		hs, err := ws.Upgrade(safeConn)
+		hs, err := upgrader.Upgrade(safeConn)
 		if err != nil {
-			log.Printf("%s: upgrade error: %v", nameConn(conn), err)
+			slog.Info("[WebSocketServer.Start] Upgrade error", logging.RemoteAddrAttr, conn.RemoteAddr().String(), "err", err)
 			conn.Close()
 			return
 		}
 
-		log.Printf("%s: established websocket connection: %+v", nameConn(conn), hs)
-
-		// Register incoming user in Connection.
-		user := w.ConnectionsManager.Register(safeConn)
+		slog.Debug("[WebSocketServer.Start] Established websocket connection", logging.RemoteAddrAttr, conn.RemoteAddr().String(), "protocol", hs.Protocol)
 
 		// Create netpoll event descriptor for conn.
 		// We want to handle only read events of it.
-		desc := netpoll.Must(netpoll.HandleRead(conn))
+		desc, err := netpoll.HandleRead(raw)
+		if err != nil {
+			// Connection was refused or closed already.
+			slog.Info("[WebSocketServer.Start] Netpoll error", logging.RemoteAddrAttr, conn.RemoteAddr().String(), "err", err)
+			conn.Close()
+			return
+		}
+
+		// Register incoming user in Connection. However the connection gets
+		// closed, even by a failed key request, we stop to receive events
+		// about it and remove it from the ConnectionsManager registry.
+		user := w.ConnectionsManager.Register(safeConn, format, properties, func(user *connections.Connection) {
+			poller.Stop(desc)
+			desc.Close()
+			w.ConnectionsManager.Remove(user)
+		})
 
 		// Subscribe to events about conn.
-		poller.Start(desc, func(ev netpoll.Event) {
+		err = poller.Start(desc, func(ev netpoll.Event) {
 			if ev&(netpoll.EventReadHup|netpoll.EventHup) != 0 {
 				// When ReadHup or Hup received, this mean that client has
 				// closed at least write end of the connection or connections
-				// itself. So we want to stop receive events about such conn
-				// and remove it from the ConnectionsManager registry.
-				poller.Stop(desc)
-				w.ConnectionsManager.Remove(user)
+				// itself.
+				user.Close()
 				return
 			}
 			// Here we can read some new message from connection.
@@ -90,23 +183,48 @@ func (w *WebSocketServer) Start() {
 			// We do not want to spawn a new goroutine to read single message.
 			// But we want to reuse previously spawned goroutine.
 			w.pool.Schedule(func() {
+				if tlsConn != nil {
+					if err := tlsConn.drain(user.Receive); err != nil {
+						user.Close()
+					}
+					return
+				}
 				if err := user.Receive(); err != nil {
 					// When receive failed, we can only disconnect broken
-					// connection and stop to receive events about it.
-					poller.Stop(desc)
-					w.ConnectionsManager.Remove(user)
+					// connection, which closes it.
+					user.Close()
 				}
 			})
 		})
+		if err != nil {
+			// The connection was closed already.
+			slog.Debug("[WebSocketServer.Start] Netpoll error", logging.RemoteAddrAttr, conn.RemoteAddr().String(), "err", err)
+			user.Close()
+			return
+		}
+		if tlsConn != nil && tlsConn.r.Buffered() > 0 {
+			// The client wrote ahead during the upgrade; the socket will
+			// not tell about data which was read already.
+			w.pool.Schedule(func() {
+				if err := tlsConn.drain(user.Receive); err != nil {
+					user.Close()
+				}
+			})
+		}
 	}
 
 	// Create incoming connections listener.
 	ln, err := net.Listen("tcp", w.addr)
 	if err != nil {
-		log.Fatal(err)
+		slog.Error("[WebSocketServer.Start] Listening failed", "addr", w.addr, "err", err)
+		os.Exit(1)
 	}
 
-	log.Printf("websocket is listening on %s", ln.Addr().String())
+	if w.TLS != nil {
+		slog.Info("[WebSocketServer.Start] Listening with tls", "addr", ln.Addr().String())
+	} else {
+		slog.Info("[WebSocketServer.Start] Listening", "addr", ln.Addr().String())
+	}
 
 	// Create netpoll descriptor for the listener.
 	// We use OneShot here to manually resume events stream when we want to.
@@ -118,10 +236,21 @@ func (w *WebSocketServer) Start() {
 	// results.
 	accept := make(chan error, 1)
 
+	w.mu.Lock()
+	if w.closing {
+		w.mu.Unlock()
+		ln.Close()
+		return
+	}
+	w.poller, w.ln, w.acceptDesc = poller, ln, acceptDesc
 	w.Listening = true // TODO get from poller status?
+	w.mu.Unlock()
 
 	// Subscribe to events about listener.
 	poller.Start(acceptDesc, func(e netpoll.Event) {
+		if w.isClosing() {
+			return
+		}
 		// We do not want to accept incoming connection when goroutine pool is
 		// busy. So if there are no free goroutines during 1ms we want to
 		// cooldown the server and do not receive connection for some short
@@ -139,6 +268,10 @@ func (w *WebSocketServer) Start() {
 		if err == nil {
 			err = <-accept
 		}
+		if err != nil && w.isClosing() {
+			// Listener was closed by Shutdown.
+			return
+		}
 		if err != nil {
 			if err != gopool.ErrScheduleTimeout {
 				goto cooldown
@@ -147,22 +280,118 @@ func (w *WebSocketServer) Start() {
 				goto cooldown
 			}
 
-			log.Fatalf("accept error: %v", err)
+			slog.Error("[WebSocketServer.Start] Accept failed", "err", err)
+			os.Exit(1)
 
 		cooldown:
 			delay := 5 * time.Millisecond
-			log.Printf("accept error: %v; retrying in %s", err, delay)
+			metrics.AcceptCooldowns.Inc()
+			slog.Warn("[WebSocketServer.Start] Accept error, retrying", "err", err, "delay", delay)
 			time.Sleep(delay)
 		}
 
 		poller.Resume(acceptDesc)
 	})
 
-	<-exit
+	<-w.exit
+}
+
+// Shutdown stops accepting connections, then shuts the ConnectionsManager
+// down, which closes every client connection. Start returns once done.
+func (w *WebSocketServer) Shutdown(ctx context.Context) error {
+	w.mu.Lock()
+	if w.closing {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closing = true
+	w.Listening = false
+	if w.ln != nil {
+		slog.Info("[WebSocketServer.Shutdown] Stopped listening", "addr", w.ln.Addr().String())
+		w.poller.Stop(w.acceptDesc)
+		w.acceptDesc.Close()
+		w.ln.Close()
+	}
+	w.mu.Unlock()
+
+	err := w.ConnectionsManager.Shutdown(ctx)
+	close(w.exit)
+	return err
+}
+
+func (w *WebSocketServer) isClosing() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.closing
+}
+
+// claimProperties returns connection properties taken from token claims.
+func claimProperties(claims *auth.Claims) map[string]string {
+	properties := map[string]string{
+		"subject": claims.Subject,
+	}
+	if claims.Tenant != "" {
+		properties["tenant"] = claims.Tenant
+	}
+	if claims.Key != "" {
+		properties[connections.KeyProperty] = claims.Key
+	}
+	return properties
 }
 
-func nameConn(conn net.Conn) string {
-	return conn.LocalAddr().String() + " > " + conn.RemoteAddr().String()
+// pendingWait is how long a tls connection is polled for more data after a
+// message was received.
+const pendingWait = time.Millisecond
+
+// bufferedConn is a net.Conn which reads through a bufio.Reader, so that
+// pending data can be peeked without consuming it.
+//
+// It lets tls connections be served from the poller. A tls.Conn reads ahead
+// and keeps decrypted data buffered, so readiness of the socket does not
+// tell whether a message is waiting. Instead every readiness event drains
+// the connection.
+type bufferedConn struct {
+	net.Conn
+	r      *bufio.Reader
+	events atomic.Int32 // readiness events not drained yet
+}
+
+func newBufferedConn(conn net.Conn) *bufferedConn {
+	return &bufferedConn{Conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
+
+// drain calls receive while data is pending. Events arriving while another
+// call drains are left to that call, so the connection is read by one
+// worker at a time and a worker never blocks on an empty connection.
+func (b *bufferedConn) drain(receive func() error) error {
+	n := b.events.Add(1)
+	if n > 1 {
+		return nil
+	}
+	for n > 0 {
+		for b.pending() {
+			if err := receive(); err != nil {
+				return err
+			}
+		}
+		n = b.events.Add(-n)
+	}
+	return nil
+}
+
+// pending reports whether data can be read within pendingWait. A timeout
+// does not break a tls.Conn, and the next Read sets its own deadline.
+func (b *bufferedConn) pending() bool {
+	if b.r.Buffered() > 0 {
+		return true
+	}
+	b.SetReadDeadline(time.Now().Add(pendingWait))
+	_, err := b.r.Peek(1)
+	return err == nil
 }
 
 // deadliner is a wrapper around net.Conn that sets read/write deadlines before
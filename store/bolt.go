@@ -0,0 +1,188 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets of the bolt database.
+var (
+	queuesBucket      = []byte("queues")      // key -> json []QueuedMessage
+	presenceBucket    = []byte("presence")    // key -> bucket of sequence -> json PresenceEvent
+	deadLettersBucket = []byte("deadLetters") // id -> json DeadLetter
+)
+
+// BoltStore keeps everything in a bbolt database file.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// OpenBoltStore opens or creates the database file at path.
+func OpenBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{queuesBucket, presenceBucket, deadLettersBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Queued(key string) ([]QueuedMessage, error) {
+	var msgs []QueuedMessage
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(queuesBucket).Get([]byte(key))
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, &msgs)
+	})
+	return msgs, err
+}
+
+func (s *BoltStore) SetQueued(key string, msgs []QueuedMessage) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(queuesBucket)
+		if len(msgs) == 0 {
+			return b.Delete([]byte(key))
+		}
+		data, err := json.Marshal(msgs)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), data)
+	})
+}
+
+func (s *BoltStore) AddPresence(e PresenceEvent, limit int) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(presenceBucket).CreateBucketIfNotExists([]byte(e.Key))
+		if err != nil {
+			return err
+		}
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		if err := b.Put(itob(seq), data); err != nil {
+			return err
+		}
+		if limit <= 0 {
+			return nil
+		}
+		// Drop the oldest events beyond limit.
+		var keys [][]byte
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		for i := 0; i < len(keys)-limit; i++ {
+			if err := b.Delete(keys[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) Presence(key string) ([]PresenceEvent, error) {
+	var events []PresenceEvent
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(presenceBucket).Bucket([]byte(key))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(_, v []byte) error {
+			var e PresenceEvent
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			events = append(events, e)
+			return nil
+		})
+	})
+	return events, err
+}
+
+func (s *BoltStore) AddDeadLetter(d *DeadLetter, limit int) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(deadLettersBucket)
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		d.ID = id
+		data, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		if err := b.Put(itob(id), data); err != nil {
+			return err
+		}
+		if limit <= 0 {
+			return nil
+		}
+		// Drop the oldest dead letters beyond limit.
+		var keys [][]byte
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		for i := 0; i < len(keys)-limit; i++ {
+			if err := b.Delete(keys[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) DeadLetters(limit int) ([]DeadLetter, error) {
+	var res []DeadLetter
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(deadLettersBucket).Cursor()
+		for k, v := c.First(); k != nil && (limit <= 0 || len(res) < limit); k, v = c.Next() {
+			var d DeadLetter
+			if err := json.Unmarshal(v, &d); err != nil {
+				return err
+			}
+			res = append(res, d)
+		}
+		return nil
+	})
+	return res, err
+}
+
+func (s *BoltStore) DeleteDeadLetter(id uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(deadLettersBucket).Delete(itob(id))
+	})
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// itob encodes a sequence number as a key which sorts in numeric order.
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
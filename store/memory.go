@@ -0,0 +1,92 @@
+package store
+
+import "sync"
+
+// MemoryStore keeps everything in memory. It is lost on restart.
+type MemoryStore struct {
+	mu          sync.Mutex
+	queues      map[string][]QueuedMessage
+	presence    map[string][]PresenceEvent
+	deadLetters []DeadLetter
+	nextId      uint64
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		queues:   make(map[string][]QueuedMessage),
+		presence: make(map[string][]PresenceEvent),
+		nextId:   1,
+	}
+}
+
+func (s *MemoryStore) Queued(key string) ([]QueuedMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]QueuedMessage(nil), s.queues[key]...), nil
+}
+
+func (s *MemoryStore) SetQueued(key string, msgs []QueuedMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(msgs) == 0 {
+		delete(s.queues, key)
+		return nil
+	}
+	s.queues[key] = append([]QueuedMessage(nil), msgs...)
+	return nil
+}
+
+func (s *MemoryStore) AddPresence(e PresenceEvent, limit int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := append(s.presence[e.Key], e)
+	if limit > 0 && len(events) > limit {
+		events = append([]PresenceEvent(nil), events[len(events)-limit:]...)
+	}
+	s.presence[e.Key] = events
+	return nil
+}
+
+func (s *MemoryStore) Presence(key string) ([]PresenceEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]PresenceEvent(nil), s.presence[key]...), nil
+}
+
+func (s *MemoryStore) AddDeadLetter(d *DeadLetter, limit int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d.ID = s.nextId
+	s.nextId++
+	s.deadLetters = append(s.deadLetters, *d)
+	if limit > 0 && len(s.deadLetters) > limit {
+		s.deadLetters = append([]DeadLetter(nil), s.deadLetters[len(s.deadLetters)-limit:]...)
+	}
+	return nil
+}
+
+func (s *MemoryStore) DeadLetters(limit int) ([]DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := s.deadLetters
+	if limit > 0 && len(res) > limit {
+		res = res[:limit]
+	}
+	return append([]DeadLetter(nil), res...), nil
+}
+
+func (s *MemoryStore) DeleteDeadLetter(id uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, d := range s.deadLetters {
+		if d.ID == id {
+			s.deadLetters = append(s.deadLetters[:i:i], s.deadLetters[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
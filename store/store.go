@@ -0,0 +1,91 @@
+package store
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spoconnor/Go-Client-Connector/config"
+	"github.com/spoconnor/Go-Client-Connector/contracts"
+)
+
+// Backends selectable in config.StoreConfig.
+const (
+	MemoryBackend = "memory"
+	BoltBackend   = "bolt"
+)
+
+// QueuedMessage is a notification waiting for its key to connect.
+type QueuedMessage struct {
+	Method  string
+	Params  contracts.RpcParams
+	Queued  time.Time
+	Expires time.Time
+}
+
+// Presence event kinds.
+const (
+	Connected    = "connected"
+	Disconnected = "disconnected"
+)
+
+// PresenceEvent records a key connecting or disconnecting.
+type PresenceEvent struct {
+	Key          string
+	ConnectionId string
+	RemoteAddr   string
+	Event        string
+	Time         time.Time
+}
+
+// DefaultDeadLetterLimit is how many dead letters are kept by default.
+const DefaultDeadLetterLimit = 10000
+
+// DeadLetter records a message which could not be delivered.
+type DeadLetter struct {
+	ID      uint64 // assigned by the store
+	Kind    string // what was not delivered, e.g. "queued-message"
+	Key     string
+	Payload interface{}
+	Reason  string
+	Time    time.Time
+}
+
+// Store keeps state which has to survive restarts. Implementations are safe
+// for concurrent use.
+type Store interface {
+	// Queued returns the messages queued for key, oldest first.
+	Queued(key string) ([]QueuedMessage, error)
+	// SetQueued replaces the messages queued for key; an empty list
+	// removes the queue.
+	SetQueued(key string, msgs []QueuedMessage) error
+
+	// AddPresence appends an event to the presence history of its key,
+	// keeping at most limit events per key.
+	AddPresence(e PresenceEvent, limit int) error
+	// Presence returns the presence history of key, oldest first.
+	Presence(key string) ([]PresenceEvent, error)
+
+	// AddDeadLetter records a dead letter, assigning its ID, and keeps at
+	// most limit dead letters, dropping the oldest.
+	AddDeadLetter(d *DeadLetter, limit int) error
+	// DeadLetters returns up to limit dead letters, oldest first.
+	DeadLetters(limit int) ([]DeadLetter, error)
+	// DeleteDeadLetter removes a dead letter.
+	DeleteDeadLetter(id uint64) error
+
+	Close() error
+}
+
+// Open opens the backend selected by cfg.
+func Open(cfg config.StoreConfig) (Store, error) {
+	switch cfg.Backend {
+	case "", MemoryBackend:
+		return NewMemoryStore(), nil
+	case BoltBackend:
+		if cfg.Path == "" {
+			return nil, fmt.Errorf("%s store needs a path", cfg.Backend)
+		}
+		return OpenBoltStore(cfg.Path)
+	}
+	return nil, fmt.Errorf("unknown store backend '%s'", cfg.Backend)
+}
@@ -0,0 +1,74 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spoconnor/Go-Client-Connector/config"
+)
+
+func testStores(t *testing.T) map[string]Store {
+	bolt, err := Open(config.StoreConfig{Backend: BoltBackend, Path: filepath.Join(t.TempDir(), "test.db")})
+	if err != nil {
+		t.Fatalf("Opening bolt store: %v", err)
+	}
+	t.Cleanup(func() { bolt.Close() })
+	return map[string]Store{MemoryBackend: NewMemoryStore(), BoltBackend: bolt}
+}
+
+func TestQueued(t *testing.T) {
+	for name, s := range testStores(t) {
+		msgs := []QueuedMessage{{Method: "one"}, {Method: "two"}}
+		if err := s.SetQueued("Device", msgs); err != nil {
+			t.Fatalf("%s: SetQueued: %v", name, err)
+		}
+		got, err := s.Queued("Device")
+		if err != nil || len(got) != 2 || got[0].Method != "one" || got[1].Method != "two" {
+			t.Errorf("%s: Queued returned %v, %v", name, got, err)
+		}
+		s.SetQueued("Device", nil)
+		if got, _ := s.Queued("Device"); len(got) != 0 {
+			t.Errorf("%s: queue not removed: %v", name, got)
+		}
+	}
+}
+
+func TestPresence(t *testing.T) {
+	for name, s := range testStores(t) {
+		for _, event := range []string{Connected, Disconnected, Connected} {
+			if err := s.AddPresence(PresenceEvent{Key: "Device", Event: event, Time: time.Now()}, 2); err != nil {
+				t.Fatalf("%s: AddPresence: %v", name, err)
+			}
+		}
+		got, err := s.Presence("Device")
+		if err != nil || len(got) != 2 || got[0].Event != Disconnected || got[1].Event != Connected {
+			t.Errorf("%s: Presence returned %v, %v", name, got, err)
+		}
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	for name, s := range testStores(t) {
+		first := &DeadLetter{Kind: "test", Key: "Device", Reason: "first"}
+		second := &DeadLetter{Kind: "test", Key: "Device", Reason: "second"}
+		s.AddDeadLetter(first, 0)
+		s.AddDeadLetter(second, 0)
+		if first.ID == second.ID {
+			t.Errorf("%s: dead letters share id %d", name, first.ID)
+		}
+		if got, _ := s.DeadLetters(1); len(got) != 1 || got[0].Reason != "first" {
+			t.Errorf("%s: DeadLetters(1) returned %v", name, got)
+		}
+		s.DeleteDeadLetter(first.ID)
+		if got, _ := s.DeadLetters(0); len(got) != 1 || got[0].ID != second.ID {
+			t.Errorf("%s: after delete got %v", name, got)
+		}
+		for _, reason := range []string{"third", "fourth"} {
+			s.AddDeadLetter(&DeadLetter{Kind: "test", Key: "Device", Reason: reason}, 2)
+		}
+		if got, _ := s.DeadLetters(0); len(got) != 2 || got[0].Reason != "third" || got[1].Reason != "fourth" {
+			t.Errorf("%s: DeadLetters beyond the limit returned %v", name, got)
+		}
+	}
+}
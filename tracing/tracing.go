@@ -0,0 +1,104 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/spoconnor/Go-Client-Connector/contracts"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Name is the instrumentation name of the connector spans.
+const Name = "github.com/spoconnor/Go-Client-Connector"
+
+// Service is the service name spans are exported under.
+const Service = "client-connector"
+
+// Stdout is the Setup endpoint writing spans to stdout.
+const Stdout = "stdout"
+
+// Attribute keys of the connector spans.
+const (
+	KeyAttribute    = attribute.Key("connector.key")
+	MethodAttribute = attribute.Key("rpc.method")
+	NodeAttribute   = attribute.Key("connector.node")
+)
+
+// propagator reads and writes W3C trace context.
+var propagator = propagation.TraceContext{}
+
+// Setup exports spans to endpoint, the url of an OTLP/HTTP collector such as
+// http://localhost:4318, or to stdout when endpoint is Stdout. It returns a
+// func flushing pending spans and stopping the exporter. Without Setup spans
+// are not recorded, but trace context of callers is still passed on.
+func Setup(endpoint string) (func(context.Context) error, error) {
+	var (
+		exporter sdktrace.SpanExporter
+		err      error
+	)
+	if endpoint == Stdout {
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	} else {
+		exporter, err = otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	}
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", Service))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagator)
+	return provider.Shutdown, nil
+}
+
+// Start starts a span named name, a child of the span of ctx.
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(Name).Start(ctx, name, opts...)
+}
+
+// End records err, if any, on span and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// WithContext returns params with the trace context of ctx added under
+// contracts.TraceParam, so the client can continue the trace. params itself
+// is not modified, and is returned as is when ctx carries no trace.
+func WithContext(ctx context.Context, params contracts.RpcParams) contracts.RpcParams {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return params
+	}
+	traced := make(contracts.RpcParams, len(params)+1)
+	for k, v := range params {
+		traced[k] = v
+	}
+	traced[contracts.TraceParam] = map[string]string(carrier)
+	return traced
+}
+
+// FromHeader returns ctx with the trace context of an incoming request.
+func FromHeader(ctx context.Context, h http.Header) context.Context {
+	return propagator.Extract(ctx, propagation.HeaderCarrier(h))
+}
+
+// ToHeader adds the trace context of ctx to an outgoing request.
+func ToHeader(ctx context.Context, h http.Header) {
+	propagator.Inject(ctx, propagation.HeaderCarrier(h))
+}
@@ -0,0 +1,42 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/spoconnor/Go-Client-Connector/contracts"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestWithContext(t *testing.T) {
+	params := contracts.RpcParams{"a": 1}
+	if got := WithContext(context.Background(), params); len(got) != 1 {
+		t.Errorf("untraced params = %v", got)
+	}
+
+	h := http.Header{}
+	h.Set("traceparent", traceparent)
+	ctx := FromHeader(context.Background(), h)
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		t.Fatal("no span context from header")
+	}
+
+	got := WithContext(ctx, params)
+	tc, ok := got[contracts.TraceParam].(map[string]string)
+	if !ok || tc["traceparent"] != traceparent {
+		t.Errorf("trace context = %v", got[contracts.TraceParam])
+	}
+	if got["a"] != 1 || len(params) != 1 {
+		t.Errorf("params = %v, original = %v", got, params)
+	}
+
+	out := http.Header{}
+	ToHeader(ctx, out)
+	if out.Get("traceparent") != traceparent {
+		t.Errorf("header traceparent = %q", out.Get("traceparent"))
+	}
+}
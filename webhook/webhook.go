@@ -0,0 +1,283 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spoconnor/Go-Client-Connector/connections"
+	"github.com/spoconnor/Go-Client-Connector/store"
+)
+
+// Headers of webhook requests. The signature is "sha256=" followed by the hex
+// encoded Sign of the timestamp and body, so receivers can verify the sender
+// and reject replayed requests.
+const (
+	EventHeader     = "X-Connector-Event"
+	DeliveryHeader  = "X-Connector-Delivery" // same for every attempt
+	TimestampHeader = "X-Connector-Timestamp"
+	SignatureHeader = "X-Connector-Signature"
+)
+
+// DeadLetterKind is the kind of dead letters of failed deliveries.
+const DeadLetterKind = "webhook"
+
+// Defaults of the Sender settings.
+const (
+	DefaultMaxAttempts = 5
+	DefaultBackoff     = time.Second
+	DefaultMaxBackoff  = time.Minute
+	DefaultWorkers     = 4
+)
+
+// requestTimeout bounds every attempt.
+const requestTimeout = 10 * time.Second
+
+// Sign returns the HMAC-SHA256 of timestamp, ".", and body, hex encoded.
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ParseURLs parses a comma separated list of webhook URLs.
+func ParseURLs(s string) []string {
+	var urls []string
+	for _, u := range strings.Split(s, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// Delivery is an event to post to one URL. Failed deliveries are kept as
+// dead letters with a Delivery payload.
+type Delivery struct {
+	ID       string
+	URL      string
+	Event    *connections.Event
+	Attempts int
+}
+
+// Sender posts connection events to webhook URLs as json. Failed attempts
+// are retried with exponential backoff; deliveries failing MaxAttempts times
+// or answered with a client error other than 408 or 429 go to the dead
+// letters of the store.
+type Sender struct {
+	secret []byte
+	store  store.Store
+	client *http.Client
+
+	// MaxAttempts is how often a delivery is attempted.
+	MaxAttempts int
+	// Backoff is the delay before the first retry, doubled for every
+	// further retry up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// DeadLetterLimit is how many dead letters the store keeps.
+	DeadLetterLimit int
+
+	mu     sync.RWMutex // guards urls and closed against sends on queue
+	urls   []string
+	closed bool
+	queue  chan *Delivery
+	stop   chan struct{} // closed to give up retries
+	halt   sync.Once
+	wg     sync.WaitGroup
+}
+
+// New creates a sender posting to urls, signing with secret and keeping
+// failed deliveries in s.
+func New(urls []string, secret []byte, s store.Store) *Sender {
+	return &Sender{
+		secret:          secret,
+		store:           s,
+		client:          &http.Client{Timeout: requestTimeout},
+		MaxAttempts:     DefaultMaxAttempts,
+		Backoff:         DefaultBackoff,
+		MaxBackoff:      DefaultMaxBackoff,
+		DeadLetterLimit: store.DefaultDeadLetterLimit,
+		urls:            urls,
+		queue:           make(chan *Delivery, 1024),
+		stop:            make(chan struct{}),
+	}
+}
+
+// Start starts workers delivering events concurrently. Events to one URL
+// may arrive out of order; their Time tells the order.
+func (s *Sender) Start(workers int) {
+	for i := 0; i < workers; i++ {
+		s.wg.Add(1)
+		go s.run()
+	}
+}
+
+// Send queues an event for every URL when a connection completed the key
+// handshake or a registered connection went away. Other events are ignored,
+// so clients which never proved their key cause no webhook traffic. It does
+// not block; when the queue is full the delivery goes to the dead letters.
+func (s *Sender) Send(e *connections.Event) {
+	if !delivered(e) {
+		return
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+	for _, url := range s.urls {
+		d := &Delivery{ID: newDeliveryId(), URL: url, Event: e}
+		select {
+		case s.queue <- d:
+		default:
+			s.deadLetter(d, "queue full")
+		}
+	}
+}
+
+// SetURLs replaces the URLs events are posted to. Queued deliveries still go
+// to their URL.
+func (s *Sender) SetURLs(urls []string) {
+	s.mu.Lock()
+	s.urls = urls
+	s.mu.Unlock()
+}
+
+// delivered reports whether webhooks are sent for e.
+func delivered(e *connections.Event) bool {
+	switch e.Type {
+	case connections.KeyAssignedEvent:
+		return true
+	case connections.DisconnectedEvent:
+		return e.Key != ""
+	}
+	return false
+}
+
+// Close stops accepting events and waits for queued deliveries. When ctx is
+// done first, retries are given up and go to the dead letters.
+func (s *Sender) Close(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.halt.Do(func() { close(s.stop) })
+		<-done
+		return ctx.Err()
+	}
+}
+
+// run delivers queued events.
+func (s *Sender) run() {
+	defer s.wg.Done()
+	for d := range s.queue {
+		s.deliver(d)
+	}
+}
+
+// deliver attempts d until it succeeds, fails for good or the sender stops.
+func (s *Sender) deliver(d *Delivery) {
+	body, err := json.Marshal(d.Event)
+	if err != nil {
+		s.deadLetter(d, err.Error())
+		return
+	}
+	backoff := s.Backoff
+	for {
+		d.Attempts++
+		retry, err := s.post(d, body)
+		if err == nil {
+			return
+		}
+		slog.Warn("[Sender.deliver] Delivery failed", "event", d.Event.Type, "url", d.URL, "attempt", d.Attempts, "err", err)
+		if !retry || d.Attempts >= s.MaxAttempts {
+			s.deadLetter(d, err.Error())
+			return
+		}
+		select {
+		case <-time.After(backoff):
+		case <-s.stop:
+			s.deadLetter(d, "shutting down: "+err.Error())
+			return
+		}
+		if backoff *= 2; backoff > s.MaxBackoff {
+			backoff = s.MaxBackoff
+		}
+	}
+}
+
+// post makes one attempt of d. It reports whether a failure is worth a
+// retry.
+func (s *Sender) post(d *Delivery, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, d.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, d.Event.Type)
+	req.Header.Set(DeliveryHeader, d.ID)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, "sha256="+Sign(s.secret, timestamp, body))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return true, fmt.Errorf("answered %d", resp.StatusCode)
+	}
+	return false, fmt.Errorf("answered %d", resp.StatusCode)
+}
+
+func (s *Sender) deadLetter(d *Delivery, reason string) {
+	err := s.store.AddDeadLetter(&store.DeadLetter{
+		Kind:    DeadLetterKind,
+		Key:     d.Event.Key,
+		Payload: d,
+		Reason:  reason,
+		Time:    time.Now().UTC(),
+	}, s.DeadLetterLimit)
+	if err != nil {
+		slog.Error("[Sender.deadLetter] Storing dead letter failed", "event", d.Event.Type, "url", d.URL, "err", err)
+	}
+}
+
+func newDeliveryId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,91 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spoconnor/Go-Client-Connector/connections"
+	"github.com/spoconnor/Go-Client-Connector/store"
+)
+
+func TestDeliver(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		attempts int
+		received []connections.Event
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		sig := strings.TrimPrefix(r.Header.Get(SignatureHeader), "sha256=")
+		if sig != Sign([]byte("secret"), r.Header.Get(TimestampHeader), body) {
+			t.Errorf("Bad signature %s", sig)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if attempts++; attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var e connections.Event
+		json.Unmarshal(body, &e)
+		received = append(received, e)
+	}))
+	defer server.Close()
+
+	st := store.NewMemoryStore()
+	s := New([]string{server.URL}, []byte("secret"), st)
+	s.Backoff = time.Millisecond
+	s.Start(1)
+	// Connections which never completed the handshake cause no traffic.
+	s.Send(&connections.Event{Type: connections.ConnectedEvent})
+	s.Send(&connections.Event{Type: connections.DisconnectedEvent})
+	s.Send(&connections.Event{Type: connections.KeyAssignedEvent, Key: "Device", Properties: map[string]string{"tenant": "acme"}})
+	if err := s.Close(context.Background()); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if len(received) != 1 || received[0].Key != "Device" || received[0].Properties["tenant"] != "acme" {
+		t.Errorf("Received %+v after %d attempts", received, attempts)
+	}
+	if dead, _ := st.DeadLetters(0); len(dead) != 0 {
+		t.Errorf("Unexpected dead letters %v", dead)
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	tests := []struct {
+		status   int
+		attempts int
+	}{
+		{http.StatusInternalServerError, 3},
+		{http.StatusBadRequest, 1},
+	}
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.status)
+		}))
+		st := store.NewMemoryStore()
+		s := New([]string{server.URL}, []byte("secret"), st)
+		s.MaxAttempts = 3
+		s.Backoff = time.Millisecond
+		s.Start(1)
+		s.Send(&connections.Event{Type: connections.DisconnectedEvent, Key: "Device"})
+		s.Close(context.Background())
+		server.Close()
+
+		dead, _ := st.DeadLetters(0)
+		if len(dead) != 1 || dead[0].Kind != DeadLetterKind || dead[0].Key != "Device" {
+			t.Fatalf("%d: dead letters %v", test.status, dead)
+		}
+		if d := dead[0].Payload.(*Delivery); d.Attempts != test.attempts {
+			t.Errorf("%d: %d attempts; want %d", test.status, d.Attempts, test.attempts)
+		}
+	}
+}